@@ -0,0 +1,111 @@
+// The files csvHasher reads and writes, compressed according to their names, with - for stdin and stdout so it can
+// sit in a pipeline
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// stdio is the file name standing for stdin or stdout
+const stdio = "-"
+
+// compression is a compressed file format, known by the extensions of its file names and the magic number at the
+// start of its files
+type compression struct {
+	extensions []string
+	magic      []byte
+	newReader  func(io.Reader) (io.Reader, error)
+	newWriter  func(io.Writer) (io.WriteCloser, error)
+}
+
+var compressions = []compression{
+	{
+		extensions: []string{".gz"},
+		magic:      []byte{0x1f, 0x8b},
+		newReader:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		newWriter:  func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+	{
+		extensions: []string{".zst", ".zstd"},
+		magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	},
+}
+
+// named reports whether the file name has one of the extensions of the compression
+func (c compression) named(fileName string) bool {
+	for _, extension := range c.extensions {
+		if strings.HasSuffix(strings.ToLower(fileName), extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// openCompressed opens the named file, or stdin for -, decompressing it when its name or, as stdin has no name, its
+// magic number says it is compressed.  The magic number of a named file isn't checked, so a file is only
+// decompressed when its name says to.
+func openCompressed(fileName string) (io.Reader, error) {
+	var f io.Reader = os.Stdin
+	if fileName != stdio {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		f = file
+	}
+	buffered := bufio.NewReader(f)
+	var magic []byte
+	if fileName == stdio {
+		magic, _ = buffered.Peek(4)
+	}
+	for _, c := range compressions {
+		if c.named(fileName) || bytes.HasPrefix(magic, c.magic) {
+			r, err := c.newReader(buffered)
+			if err != nil {
+				return nil, fmt.Errorf("error decompressing %s: %v", fileName, err)
+			}
+			return r, nil
+		}
+	}
+	return buffered, nil
+}
+
+// createCompressed creates the named file, or writes to stdout for -, compressing it when its name says to.  Closing
+// the writer returned flushes the compression.
+func createCompressed(fileName string) (io.WriteCloser, error) {
+	var f io.WriteCloser = os.Stdout
+	if fileName != stdio {
+		file, err := os.Create(fileName)
+		if err != nil {
+			return nil, err
+		}
+		f = file
+	}
+	for _, c := range compressions {
+		if c.named(fileName) {
+			w, err := c.newWriter(f)
+			if err != nil {
+				return nil, err
+			}
+			return closers{w, f}, nil
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,143 @@
+// The CSV dialects and character encodings csvHasher reads and writes, so HR exports don't need converting first
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Dialect is how the records of a CSV file are separated, commented and encoded
+type Dialect struct {
+	Delimiter  rune
+	Comment    rune // lines starting with it are skipped when reading, 0 for none
+	LazyQuotes bool
+	Encoding   string
+}
+
+// characterEncoding is a character encoding a CSV file can be read or written in
+type characterEncoding struct {
+	encoding    encoding.Encoding // nil for UTF-8, which needs no conversion
+	description string
+}
+
+// characterEncodings are the encodings known by -input_encoding and -output_encoding, keyed by their names in lower
+// case without "-" or "_".  UTF-16 files are written with a byte order mark, and read in the order their byte order
+// mark gives, defaulting to little endian as written by Windows.
+var characterEncodings = map[string]characterEncoding{
+	"utf8":        {nil, "UTF-8, the default"},
+	"utf16":       {unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), "UTF-16 in the order of the byte order mark"},
+	"utf16le":     {unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "UTF-16 little endian"},
+	"utf16be":     {unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "UTF-16 big endian"},
+	"latin1":      {charmap.ISO8859_1, "ISO 8859-1"},
+	"iso88591":    {charmap.ISO8859_1, "ISO 8859-1"},
+	"iso885915":   {charmap.ISO8859_15, "ISO 8859-15, Latin-1 with the euro sign"},
+	"windows1252": {charmap.Windows1252, "the Windows superset of Latin-1"},
+	"cp1252":      {charmap.Windows1252, "the Windows superset of Latin-1"},
+}
+
+// encodingName returns the key of an encoding in characterEncodings
+func encodingName(name string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+// encodingNames returns the names of the known encodings in order, for the help text and errors
+func encodingNames() []string {
+	var names []string
+	for name := range characterEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkEncoding returns an error if the encoding isn't known
+func checkEncoding(name string) error {
+	if _, ok := characterEncodings[encodingName(name)]; !ok {
+		return fmt.Errorf("unknown encoding %s, expected one of %s", name, strings.Join(encodingNames(), ", "))
+	}
+	return nil
+}
+
+// parseDelimiter returns the character given for a delimiter or comment, which can be "tab" or "\t" for a tab
+func parseDelimiter(flagName string, value string) (rune, error) {
+	switch strings.ToLower(value) {
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(value)
+	if size == 0 || size != len(value) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("%s must be a single character other than a quote or new line, not %q", flagName, value)
+	}
+	return r, nil
+}
+
+// reader returns a csv reader decoding the file to UTF-8.  Files saved by Excel and Windows tools start with a byte
+// order mark, which is skipped rather than becoming part of the first column name.
+func (d Dialect) reader(f io.Reader) *csv.Reader {
+	if e := characterEncodings[encodingName(d.Encoding)].encoding; e != nil {
+		f = transform.NewReader(f, e.NewDecoder())
+	}
+	buffered := bufio.NewReader(f)
+	if bom, err := buffered.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		buffered.Discard(3)
+	}
+	reader := csv.NewReader(buffered)
+	reader.Comma = d.Delimiter
+	reader.Comment = d.Comment
+	reader.LazyQuotes = d.LazyQuotes
+	// Records with the wrong number of fields are rejected by the validation rather than stopping the run
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// writer returns a csv writer encoding the records written to f, and the closer that flushes the encoding.  Values
+// that can't be represented in the encoding are errors rather than being replaced.
+func (d Dialect) writer(f io.WriteCloser) (*csv.Writer, io.Closer) {
+	if e := characterEncodings[encodingName(d.Encoding)].encoding; e != nil {
+		f = closers{encodingWriter{transform.NewWriter(f, e.NewEncoder()), d.Encoding}, f}
+	}
+	writer := csv.NewWriter(f)
+	writer.Comma = d.Delimiter
+	return writer, f
+}
+
+// closers writes to the first of a stack of writers, and closes each in turn so each flushes into those below it
+type closers []io.WriteCloser
+
+func (c closers) Write(p []byte) (int, error) {
+	return c[0].Write(p)
+}
+
+func (c closers) Close() error {
+	for _, closer := range c {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodingWriter names the encoding in the errors of the writer encoding to it, as the encoder's own don't
+type encodingWriter struct {
+	io.WriteCloser
+	name string
+}
+
+func (w encodingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if err != nil {
+		err = fmt.Errorf("error encoding to %s: %v", w.name, err)
+	}
+	return n, err
+}
@@ -1,3 +1,12 @@
 module github.ibm.com/bachmann/csvHasher
 
-go 1.17
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.9.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.8.0 // indirect
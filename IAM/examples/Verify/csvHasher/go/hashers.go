@@ -0,0 +1,363 @@
+// The hash schemes csvHasher can generate userPassword values in, each registered by the name given to -scheme
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"math/bits"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HashParams holds the cost parameters of the hash schemes, 0 meaning the scheme's default
+type HashParams struct {
+	SaltLength       int
+	Pbkdf2Iterations int
+	BcryptCost       int
+	ScryptN          int
+	ScryptR          int
+	ScryptP          int
+	Argon2Time       int
+	Argon2Memory     int
+	Argon2Threads    int
+}
+
+// hasher generates the userPassword value of a clear text value
+type hasher interface {
+	hash(value string) (string, error)
+}
+
+// hashScheme is a scheme in the registry
+type hashScheme struct {
+	description string
+	newHasher   func(params HashParams) (hasher, error)
+}
+
+// hashSchemes is the registry of schemes by upper case name
+var hashSchemes = map[string]hashScheme{}
+
+// hashedPrefixes are the {SCHEME} prefixes of values that are already hashed, each with a check of the rest of the
+// value so a clear text password that happens to start with one isn't taken for a hash
+var hashedPrefixes = map[string]func(rest string) bool{}
+
+// registerScheme adds a scheme to the registry.  The prefix of its values is added by recognisePrefix with a check of
+// their format.
+func registerScheme(name string, description string, newHasher func(params HashParams) (hasher, error)) {
+	hashSchemes[name] = hashScheme{description: description, newHasher: newHasher}
+}
+
+// recognisePrefix adds a prefix of hashed values, the rest of which must pass check
+func recognisePrefix(prefix string, check func(rest string) bool) {
+	hashedPrefixes[prefix] = check
+}
+
+// recognisePattern adds a prefix of hashed values, the rest of which must match the pattern
+func recognisePattern(prefix string, pattern string) {
+	re := regexp.MustCompile(pattern)
+	recognisePrefix(prefix, re.MatchString)
+}
+
+// isHashed reports whether the value already carries the {SCHEME} prefix of a recognised scheme
+func isHashed(value string) bool {
+	if !strings.HasPrefix(value, "{") {
+		return false
+	}
+	end := strings.Index(value, "}")
+	if end < 0 {
+		return false
+	}
+	check, ok := hashedPrefixes[strings.ToUpper(value[1:end])]
+	return ok && check(value[end+1:])
+}
+
+// schemeNames returns the names of the registered schemes in order
+func schemeNames() []string {
+	var names []string
+	for name := range hashSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schemeName returns the registry name of a scheme given in any case, with or without braces
+func schemeName(scheme string) string {
+	return strings.ToUpper(strings.Trim(scheme, "{}"))
+}
+
+// newHasher returns the hasher for the named scheme with the given cost parameters
+func newHasher(scheme string, params HashParams) (hasher, error) {
+	registered, ok := hashSchemes[schemeName(scheme)]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheme %s, expected one of %s", scheme, strings.Join(schemeNames(), ", "))
+	}
+	return registered.newHasher(params)
+}
+
+func init() {
+	registerDigestScheme("SHA", sha1.New, false)
+	registerDigestScheme("SHA256", sha256.New, false)
+	registerDigestScheme("SHA512", sha512.New, false)
+	registerDigestScheme("SSHA", sha1.New, true)
+	registerDigestScheme("SSHA256", sha256.New, true)
+	registerDigestScheme("SSHA512", sha512.New, true)
+	registerPbkdf2Scheme("PBKDF2", sha1.New)
+	registerPbkdf2Scheme("PBKDF2-SHA256", sha256.New)
+	registerPbkdf2Scheme("PBKDF2-SHA512", sha512.New)
+	registerScheme("BCRYPT", "{CRYPT}$2b$ bcrypt hash", newBcryptHasher)
+	registerScheme("SCRYPT", "{SCRYPT}$scrypt$ scrypt hash", newScryptHasher)
+	registerScheme("ARGON2", "{ARGON2}$argon2id$ Argon2id hash", newArgon2Hasher)
+	// Only bcrypt hashes are taken for {CRYPT} ones, as the other crypt(3) formats are too loose to tell from a password
+	recognisePattern("CRYPT", `^\$2[aby]\$[0-9]{2}\$[./A-Za-z0-9]{53}$`)
+	recognisePattern("SCRYPT", `^\$scrypt\$ln=[0-9]+,r=[0-9]+,p=[0-9]+\$[./A-Za-z0-9]+\$[./A-Za-z0-9]{43}$`)
+	recognisePattern("ARGON2", `^\$argon2(id|i|d)\$v=[0-9]+\$m=[0-9]+,t=[0-9]+,p=[0-9]+\$[+/A-Za-z0-9]+\$[+/A-Za-z0-9]+$`)
+	// Schemes csvHasher doesn't generate, but values of which it leaves alone
+	recogniseDigestPrefix("MD5", 16, false)
+	recogniseDigestPrefix("SMD5", 16, true)
+	recogniseDigestPrefix("SHA224", 28, false)
+	recogniseDigestPrefix("SSHA224", 28, true)
+	recogniseDigestPrefix("SHA384", 48, false)
+	recogniseDigestPrefix("SSHA384", 48, true)
+	recognisePbkdf2Prefix("PBKDF2-SHA1", sha1.Size)
+}
+
+// defaultInt returns value, or def when it is 0
+func defaultInt(value int, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// randomSalt returns length cryptographically random bytes
+func randomSalt(length int) ([]byte, error) {
+	salt := make([]byte, length)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+	return salt, nil
+}
+
+// adaptedBase64 is the base64 alphabet of the modular crypt formats, with "." in place of "+" and no padding
+var adaptedBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// digestHasher generates the {SHA}, {SHA256} and {SHA512} values of the draft-stroeder spec and their salted
+// {SSHA} forms, which hash the value followed by the salt and append the salt to the digest
+type digestHasher struct {
+	scheme     string
+	newHash    func() hash.Hash
+	saltLength int
+}
+
+func registerDigestScheme(scheme string, newHash func() hash.Hash, salted bool) {
+	description := fmt.Sprintf("{%s} unsalted digest", scheme)
+	if salted {
+		description = fmt.Sprintf("{%s} digest with a random salt of salt_length bytes (defaults to 8)", scheme)
+	}
+	registerScheme(scheme, description, func(params HashParams) (hasher, error) {
+		h := &digestHasher{scheme: scheme, newHash: newHash}
+		if salted {
+			h.saltLength = defaultInt(params.SaltLength, 8)
+			if h.saltLength < 4 {
+				return nil, fmt.Errorf("salt_length must be at least 4")
+			}
+		}
+		return h, nil
+	})
+	recogniseDigestPrefix(scheme, newHash().Size(), salted)
+}
+
+// recogniseDigestPrefix adds the prefix of a digest scheme, checking the rest of the value is the base64 of a digest
+// of the given size, followed by a salt for the salted schemes
+func recogniseDigestPrefix(prefix string, size int, salted bool) {
+	recognisePrefix(prefix, func(rest string) bool {
+		decoded, err := base64.StdEncoding.DecodeString(rest)
+		return err == nil && (len(decoded) == size || salted && len(decoded) > size)
+	})
+}
+
+func (h *digestHasher) hash(value string) (string, error) {
+	salt, err := randomSalt(h.saltLength)
+	if err != nil {
+		return "", err
+	}
+	digest := h.newHash()
+	digest.Write([]byte(value))
+	digest.Write(salt)
+	sum := append(digest.Sum(nil), salt...)
+	return "{" + h.scheme + "}" + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// pbkdf2Hasher generates values in the format of the OpenLDAP pw-pbkdf2 module, {PBKDF2-SHA256}iterations$salt$key
+// with the salt and derived key in adapted base64
+type pbkdf2Hasher struct {
+	scheme     string
+	newHash    func() hash.Hash
+	iterations int
+	saltLength int
+}
+
+func registerPbkdf2Scheme(scheme string, newHash func() hash.Hash) {
+	description := fmt.Sprintf("{%s} with pbkdf2_iterations rounds (defaults to 100000)", scheme)
+	registerScheme(scheme, description, func(params HashParams) (hasher, error) {
+		h := &pbkdf2Hasher{
+			scheme:     scheme,
+			newHash:    newHash,
+			iterations: defaultInt(params.Pbkdf2Iterations, 100000),
+			saltLength: defaultInt(params.SaltLength, 16),
+		}
+		if h.iterations < 1000 {
+			return nil, fmt.Errorf("pbkdf2_iterations must be at least 1000")
+		}
+		if h.saltLength < 8 {
+			return nil, fmt.Errorf("salt_length must be at least 8 for %s", scheme)
+		}
+		return h, nil
+	})
+	recognisePbkdf2Prefix(scheme, newHash().Size())
+}
+
+// recognisePbkdf2Prefix adds the prefix of a PBKDF2 scheme, checking the rest of the value is an iteration count, a
+// salt and a derived key of the size of the scheme's digest, the salt and key in adapted base64
+func recognisePbkdf2Prefix(prefix string, size int) {
+	recognisePrefix(prefix, func(rest string) bool {
+		fields := strings.Split(rest, "$")
+		if len(fields) != 3 {
+			return false
+		}
+		if iterations, err := strconv.Atoi(fields[0]); err != nil || iterations < 1 {
+			return false
+		}
+		salt, err := adaptedBase64.DecodeString(fields[1])
+		if err != nil || len(salt) == 0 {
+			return false
+		}
+		key, err := adaptedBase64.DecodeString(fields[2])
+		return err == nil && len(key) == size
+	})
+}
+
+func (h *pbkdf2Hasher) hash(value string) (string, error) {
+	salt, err := randomSalt(h.saltLength)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(value), salt, h.iterations, h.newHash().Size(), h.newHash)
+	return fmt.Sprintf("{%s}%d$%s$%s", h.scheme, h.iterations, adaptedBase64.EncodeToString(salt),
+		adaptedBase64.EncodeToString(key)), nil
+}
+
+// bcryptHasher generates {CRYPT} values holding a $2b$ bcrypt hash
+type bcryptHasher struct {
+	cost int
+}
+
+func newBcryptHasher(params HashParams) (hasher, error) {
+	h := &bcryptHasher{cost: defaultInt(params.BcryptCost, bcrypt.DefaultCost)}
+	if h.cost < bcrypt.MinCost || h.cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return h, nil
+}
+
+func (h *bcryptHasher) hash(value string) (string, error) {
+	// bcrypt only uses the first 72 bytes, so longer values would be truncated without notice
+	if len(value) > 72 {
+		return "", fmt.Errorf("bcrypt values can't be longer than 72 bytes")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(value), h.cost)
+	if err != nil {
+		return "", err
+	}
+	// The Go implementation doesn't have the bug $2b$ was introduced to mark as fixed, so its hashes are $2b$ ones
+	return "{CRYPT}$2b$" + strings.TrimPrefix(string(hashed), "$2a$"), nil
+}
+
+// scryptHasher generates {SCRYPT} values in the passlib format, $scrypt$ln=15,r=8,p=1$salt$key with the salt and key
+// in adapted base64
+type scryptHasher struct {
+	n, r, p    int
+	saltLength int
+}
+
+func newScryptHasher(params HashParams) (hasher, error) {
+	h := &scryptHasher{
+		n:          defaultInt(params.ScryptN, 32768),
+		r:          defaultInt(params.ScryptR, 8),
+		p:          defaultInt(params.ScryptP, 1),
+		saltLength: defaultInt(params.SaltLength, 16),
+	}
+	if h.n < 2 || h.n&(h.n-1) != 0 {
+		return nil, fmt.Errorf("scrypt_n must be a power of 2")
+	}
+	if h.r < 1 || h.p < 1 || h.r*h.p >= 1<<30 {
+		return nil, fmt.Errorf("scrypt_r and scrypt_p must be positive with a product less than 2^30")
+	}
+	if h.saltLength < 8 {
+		return nil, fmt.Errorf("salt_length must be at least 8 for SCRYPT")
+	}
+	return h, nil
+}
+
+func (h *scryptHasher) hash(value string) (string, error) {
+	salt, err := randomSalt(h.saltLength)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(value), salt, h.n, h.r, h.p, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("{SCRYPT}$scrypt$ln=%d,r=%d,p=%d$%s$%s", bits.TrailingZeros(uint(h.n)), h.r, h.p,
+		adaptedBase64.EncodeToString(salt), adaptedBase64.EncodeToString(key)), nil
+}
+
+// argon2Hasher generates {ARGON2} values in the PHC string format of the OpenLDAP pw-argon2 module,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key with the salt and key in unpadded base64
+type argon2Hasher struct {
+	time, memory uint32
+	threads      uint8
+	saltLength   int
+}
+
+func newArgon2Hasher(params HashParams) (hasher, error) {
+	time := defaultInt(params.Argon2Time, 3)
+	memory := defaultInt(params.Argon2Memory, 65536)
+	threads := defaultInt(params.Argon2Threads, 4)
+	if time < 1 {
+		return nil, fmt.Errorf("argon2_time must be at least 1")
+	}
+	if threads < 1 || threads > 255 {
+		return nil, fmt.Errorf("argon2_threads must be between 1 and 255")
+	}
+	if memory < 8*threads {
+		return nil, fmt.Errorf("argon2_memory must be at least 8 KiB per thread")
+	}
+	h := &argon2Hasher{time: uint32(time), memory: uint32(memory), threads: uint8(threads), saltLength: defaultInt(params.SaltLength, 16)}
+	if h.saltLength < 8 {
+		return nil, fmt.Errorf("salt_length must be at least 8 for ARGON2")
+	}
+	return h, nil
+}
+
+func (h *argon2Hasher) hash(value string) (string, error) {
+	salt, err := randomSalt(h.saltLength)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(value), salt, h.time, h.memory, h.threads, 32)
+	return fmt.Sprintf("{ARGON2}$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
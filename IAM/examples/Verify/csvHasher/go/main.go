@@ -1,78 +1,208 @@
-// csvHasher converts the specified column of a CSV file to SHA256 format
+// csvHasher converts the specified columns of a CSV file to SHA256 format, or any of the schemes in hashers.go,
+// optionally running the other steps of the transform pipeline in transform.go to prepare a Verify bulk user import
 // The format generated is consistent with https://docs.ldap.com/specs/draft-stroeder-hashed-userpassword-values-01.txt
 
 package main
 
 import (
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/base64"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ConfigInfo struct {
 	inputFileName  string
 	outputFileName string
+	rejectFileName string
 	logLevel       string
-	ColumnName     string
-	ColumnNumber   int
+	Columns        []ColumnInfo
 	HashSize       int
+	Scheme         string
+	HashParams     HashParams
+	Pipeline       []transformStep
+	Validation     ValidationConfig
+	Rehash         bool
+	Workers        int
+	Progress       time.Duration
+	NoHeader       bool
+	InputDialect   Dialect
+	OutputDialect  Dialect
+}
+
+// ColumnInfo is a column to hash and the scheme to hash it with
+type ColumnInfo struct {
+	ColumnName   string
+	ColumnNumber int
+	Scheme       string
+	Hasher       hasher
+}
+
+// name returns the column's name, or #number when it is given by number
+func (c ColumnInfo) name() string {
+	if c.ColumnName != "" {
+		return c.ColumnName
+	}
+	return "#" + strconv.Itoa(c.ColumnNumber+1)
+}
+
+// columnList collects the repeated -column arguments
+type columnList []ColumnInfo
+
+func (c *columnList) String() string {
+	var columns []string
+	for _, column := range *c {
+		columns = append(columns, column.ColumnName)
+	}
+	return strings.Join(columns, ",")
+}
+
+// Set parses a -column argument, name:scheme, with the scheme defaulting to -scheme and #number in place of the name
+// to give the column by number.  A name containing ":" is only split when what follows the last ":" is a scheme.
+func (c *columnList) Set(value string) error {
+	column := ColumnInfo{ColumnName: value}
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		if _, ok := hashSchemes[schemeName(value[i+1:])]; ok {
+			column.ColumnName, column.Scheme = value[:i], value[i+1:]
+		}
+	}
+	if strings.HasPrefix(column.ColumnName, "#") {
+		number, err := strconv.Atoi(column.ColumnName[1:])
+		if err != nil || number < 1 {
+			return fmt.Errorf("invalid column number %s", column.ColumnName)
+		}
+		column.ColumnName = ""
+		column.ColumnNumber = number - 1
+	} else if column.ColumnName == "" {
+		return fmt.Errorf("missing column name in %s", value)
+	}
+	*c = append(*c, column)
+	return nil
 }
 
 func main() {
 	configInfo := getArguments()
-	inputCsvReader := openInputFile(configInfo.inputFileName)
-	outputCsvWriter := openOutputFile(configInfo.outputFileName)
-	recordCount := 0
-	for {
-		record, err := inputCsvReader.Read()
-		if err == io.EOF {
-			break
+	inputCsvReader := openInputFile(configInfo.inputFileName, configInfo.InputDialect)
+	outputCsvWriter, outputCloser := openOutputFile(configInfo.outputFileName, configInfo.OutputDialect)
+	// Rejected records are written as they were read, so once corrected they can be run through again
+	rejected := openRejects(configInfo.rejectFileName, Dialect{Delimiter: configInfo.InputDialect.Delimiter, Encoding: configInfo.InputDialect.Encoding})
+	validator := &validator{config: configInfo.Validation, rehash: configInfo.Rehash}
+	header, err := inputCsvReader.Read()
+	if err != nil && err != io.EOF {
+		log.Fatalln("error reading record from csv:", err)
+	}
+	read, written := 0, 0
+	if err == nil {
+		// Without a header the first line is data, and the columns can only be given by number, as #number
+		var first []string
+		if configInfo.NoHeader {
+			first = header
+			header = make([]string, len(first))
+			for i := range header {
+				header[i] = "#" + strconv.Itoa(i+1)
+			}
 		}
-		if err != nil {
-			log.Fatalln("error reading record from csv:", err)
+		record := header
+		if err = validator.setHeader(header); err == nil && !configInfo.NoHeader {
+			err = rejected.writeHeader(header)
 		}
-		recordCount++
-		if recordCount == 1 {
-			if configInfo.ColumnName != "" {
-				getColumnNumber(&configInfo, record)
-			}
-		} else {
-			if configInfo.HashSize == 512 {
-				hash512SpecifiedColumn(record, configInfo.ColumnNumber)
-			} else {
-				hash256SpecifiedColumn(record, configInfo.ColumnNumber)
+		for _, step := range configInfo.Pipeline {
+			if err != nil {
+				break
 			}
+			record, err = step.header(record)
+		}
+		if err != nil && configInfo.NoHeader {
+			err = fmt.Errorf("%v, with -no_header columns are given as #number", err)
 		}
-		err = outputCsvWriter.Write(record)
 		if err != nil {
-			log.Fatalln("error writing record to csv:", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		checkDuplicateColumns(configInfo.Columns, header)
+		if !configInfo.NoHeader {
+			if err = outputCsvWriter.Write(record); err != nil {
+				log.Fatalln("error writing record to csv:", err)
+			}
+		}
+		read, written = processRecords(&configInfo, first, inputCsvReader, outputCsvWriter, rejected, validator)
 	}
 	outputCsvWriter.Flush()
 	if err := outputCsvWriter.Error(); err != nil {
 		log.Fatal(err)
 	}
+	if err := outputCloser.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rejected.close(); err != nil {
+		log.Fatal(err)
+	}
+	var passedThrough int64
+	for _, step := range configInfo.Pipeline {
+		if hashStep, ok := step.(*hashStep); ok {
+			passedThrough += hashStep.passedThrough
+		}
+	}
+	if read > 0 && (configInfo.Validation.enabled() || configInfo.rejectFileName != "" || rejected.total > 0 || passedThrough > 0) {
+		rejected.printSummary(read, written, passedThrough)
+	}
+	if rejected.total > 0 {
+		os.Exit(2)
+	}
 	return
 }
 
 //getArguments validates command line argument passed in
 func getArguments() (configInfo ConfigInfo) {
 	fs := flag.NewFlagSet("csvHasher", flag.ContinueOnError)
-	inputFileName := fs.String("input_file", "", "Name of database snapshot file")
-	outputFileName := fs.String("output_file", "", "Name of database analysis output files (defaults to stdout)")
+	inputFileName := fs.String("input_file", "", "Name of database snapshot file, or - for stdin, decompressed if .gz or .zst")
+	outputFileName := fs.String("output_file", "", "Name of database analysis output files, or - for stdout, compressed if .gz or .zst")
 	helpArg := fs.Bool("help", false, "Display the full help text")
 	loglevelArg := fs.String("loglevel", "CRITICAL", "Logging Level (defaults to CRITICAL).")
 	ColumnName := fs.String("column_name", "", "column to hash")
 	ColumnNumber := fs.Int("column_number", 0, "column to hash")
+	NoHeader := fs.Bool("no_header", false, "the first line is data rather than a header, so columns are given by number")
+	Delimiter := fs.String("delimiter", ",", "character separating the fields of input_file, such as ; or tab")
+	OutputDelimiter := fs.String("output_delimiter", ",", "character separating the fields of output_file")
+	Comment := fs.String("comment", "", "character starting the comment lines of input_file to skip (defaults to none)")
+	LazyQuotes := fs.Bool("lazy_quotes", false, "allow quotes in unquoted fields and unescaped quotes in quoted fields of input_file")
+	InputEncoding := fs.String("input_encoding", "UTF-8", "character encoding of input_file, such as UTF-16 or Latin-1")
+	OutputEncoding := fs.String("output_encoding", "UTF-8", "character encoding of output_file")
+	var Columns columnList
+	fs.Var(&Columns, "column", "column to hash as name:scheme or #number:scheme, can be repeated")
+	TransformFileName := fs.String("transform", "", "YAML file of transform steps and validation")
+	var Steps stepList
+	fs.Var(&Steps, "step", "transform step as op=arguments, can be repeated")
+	Workers := fs.Int("workers", runtime.NumCPU(), "number of records hashed concurrently (defaults to the number of CPUs)")
+	Progress := fs.Duration("progress", 0, "interval to report the records processed and records/sec on stderr, e.g. 10s (defaults to none)")
+	Rehash := fs.Bool("rehash", false, "hash values that already carry a recognised {SCHEME} prefix again")
+	RejectFileName := fs.String("reject_file", "", "CSV file for the records failing validation (defaults to reporting them on stderr)")
+	Required := fs.String("required", "", "comma separated columns that must not be empty")
+	EmailColumns := fs.String("email_column", "", "comma separated columns that must hold valid email addresses")
+	UniqueColumns := fs.String("unique_column", "", "comma separated columns, such as the user ID, whose values must not repeat")
+	PasswordColumns := fs.String("password_column", "", "comma separated columns the password policy is checked on before hashing (defaults to the columns hashed)")
+	PasswordMinLength := fs.Int("password_min_length", 0, "minimum password length")
+	PasswordMaxLength := fs.Int("password_max_length", 0, "maximum password length")
+	PasswordClasses := fs.Int("password_classes", 0, "number of lower case, upper case, digit and other characters classes passwords must contain")
 	HashSize := fs.Int("hash_size", 256, "Hash size (defaults to 256)")
+	Scheme := fs.String("scheme", "", "Hash scheme, see -help (defaults to SHA256 or SHA512 from hash_size)")
+	SaltLength := fs.Int("salt_length", 0, "Length in bytes of the random salt (defaults to 8 for SSHA, 16 for the others)")
+	Pbkdf2Iterations := fs.Int("pbkdf2_iterations", 0, "PBKDF2 iteration count (defaults to 100000)")
+	BcryptCost := fs.Int("bcrypt_cost", 0, "bcrypt cost (defaults to 10)")
+	ScryptN := fs.Int("scrypt_n", 0, "scrypt CPU/memory cost, a power of 2 (defaults to 32768)")
+	ScryptR := fs.Int("scrypt_r", 0, "scrypt block size (defaults to 8)")
+	ScryptP := fs.Int("scrypt_p", 0, "scrypt parallelism (defaults to 1)")
+	Argon2Time := fs.Int("argon2_time", 0, "Argon2 passes over memory (defaults to 3)")
+	Argon2Memory := fs.Int("argon2_memory", 0, "Argon2 memory in KiB (defaults to 65536)")
+	Argon2Threads := fs.Int("argon2_threads", 0, "Argon2 parallelism (defaults to 4)")
 
-	UsageString := "Usage csvHasher -input_file csv_file -output_file csv_file [-column_name column_name | -column_number column_number] [-hash_size 256 | 512]\n"
+	UsageString := "Usage csvHasher -input_file csv_file -output_file csv_file [-column_name column_name | -column_number column_number | -column name:scheme ...] [-no_header] [dialect options] [-transform yaml_file] [-step op=arguments ...] [validation options] [-reject_file csv_file] [-rehash] [-workers n] [-progress interval] [-hash_size 256 | 512] [-scheme scheme] [cost options]\n"
 
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, UsageString)
@@ -93,7 +223,21 @@ func getArguments() (configInfo ConfigInfo) {
 		fmt.Fprintf(os.Stderr, UsageString)
 		os.Exit(1)
 	}
-	if *ColumnNumber == 0 && *ColumnName == "" {
+	if *outputFileName == stdio && *RejectFileName == stdio {
+		fmt.Fprintf(os.Stderr, "Error: output_file and reject_file can't both be written to stdout\n")
+		fmt.Fprintf(os.Stderr, UsageString)
+		os.Exit(1)
+	}
+	validationFlags := ValidationConfig{
+		Required:          splitList(*Required),
+		EmailColumns:      splitList(*EmailColumns),
+		UniqueColumns:     splitList(*UniqueColumns),
+		PasswordColumns:   splitList(*PasswordColumns),
+		PasswordMinLength: *PasswordMinLength,
+		PasswordMaxLength: *PasswordMaxLength,
+		PasswordClasses:   *PasswordClasses,
+	}
+	if *ColumnNumber == 0 && *ColumnName == "" && len(Columns) == 0 && *TransformFileName == "" && len(Steps) == 0 && !validationFlags.enabled() {
 		fmt.Fprintf(os.Stderr, "Error: missing hash column name and number\n")
 		fmt.Fprintf(os.Stderr, UsageString)
 		os.Exit(1)
@@ -101,10 +245,46 @@ func getArguments() (configInfo ConfigInfo) {
 
 	configInfo.inputFileName = *inputFileName
 	configInfo.outputFileName = *outputFileName
-	if *ColumnNumber != 0 {
-		configInfo.ColumnNumber = *ColumnNumber - 1
+	configInfo.rejectFileName = *RejectFileName
+	configInfo.Rehash = *Rehash
+	configInfo.Progress = *Progress
+	configInfo.NoHeader = *NoHeader
+	var err error
+	configInfo.InputDialect = Dialect{LazyQuotes: *LazyQuotes, Encoding: *InputEncoding}
+	configInfo.OutputDialect = Dialect{Encoding: *OutputEncoding}
+	if configInfo.InputDialect.Delimiter, err = parseDelimiter("delimiter", *Delimiter); err == nil {
+		configInfo.OutputDialect.Delimiter, err = parseDelimiter("output_delimiter", *OutputDelimiter)
+	}
+	if err == nil && *Comment != "" {
+		configInfo.InputDialect.Comment, err = parseDelimiter("comment", *Comment)
+		if err == nil && configInfo.InputDialect.Comment == configInfo.InputDialect.Delimiter {
+			err = fmt.Errorf("comment must differ from the delimiter")
+		}
+	}
+	if err == nil {
+		if err = checkEncoding(*InputEncoding); err == nil {
+			err = checkEncoding(*OutputEncoding)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, UsageString)
+		os.Exit(1)
+	}
+	if *Workers < 1 {
+		fmt.Fprintf(os.Stderr, "Error: workers must be at least 1\n")
+		fmt.Fprintf(os.Stderr, UsageString)
+		os.Exit(1)
+	}
+	configInfo.Workers = *Workers
+	if *ColumnNumber != 0 || *ColumnName != "" {
+		column := ColumnInfo{ColumnName: *ColumnName}
+		if *ColumnNumber != 0 {
+			column.ColumnNumber = *ColumnNumber - 1
+		}
+		configInfo.Columns = append(configInfo.Columns, column)
 	}
-	configInfo.ColumnName = *ColumnName
+	configInfo.Columns = append(configInfo.Columns, Columns...)
 	configInfo.logLevel = *loglevelArg
 
 	switch *HashSize {
@@ -120,68 +300,164 @@ func getArguments() (configInfo ConfigInfo) {
 		fmt.Fprintf(os.Stderr, UsageString)
 		os.Exit(1)
 	}
+
+	configInfo.Scheme = *Scheme
+	if configInfo.Scheme == "" {
+		configInfo.Scheme = fmt.Sprintf("SHA%d", configInfo.HashSize)
+	}
+	configInfo.HashParams = HashParams{
+		SaltLength:       *SaltLength,
+		Pbkdf2Iterations: *Pbkdf2Iterations,
+		BcryptCost:       *BcryptCost,
+		ScryptN:          *ScryptN,
+		ScryptR:          *ScryptR,
+		ScryptP:          *ScryptP,
+		Argon2Time:       *Argon2Time,
+		Argon2Memory:     *Argon2Memory,
+		Argon2Threads:    *Argon2Threads,
+	}
+	for i := range configInfo.Columns {
+		column := &configInfo.Columns[i]
+		if column.Scheme == "" {
+			column.Scheme = configInfo.Scheme
+		}
+		var err error
+		column.Hasher, err = newHasher(column.Scheme, configInfo.HashParams)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, UsageString)
+			os.Exit(1)
+		}
+	}
+
+	// The columns to hash are hashed before the transform steps, from the YAML file and then -step, are run
+	if len(configInfo.Columns) > 0 {
+		step := &hashStep{rehash: configInfo.Rehash}
+		for i := range configInfo.Columns {
+			step.columns = append(step.columns, &configInfo.Columns[i])
+		}
+		configInfo.Pipeline = append(configInfo.Pipeline, step)
+	}
+	var stepConfigs []StepConfig
+	if *TransformFileName != "" {
+		transformConfig, err := readTransformConfig(*TransformFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *TransformFileName, err)
+			os.Exit(1)
+		}
+		stepConfigs = append(stepConfigs, transformConfig.Steps...)
+		configInfo.Validation = transformConfig.Validation
+	}
+	configInfo.Validation.merge(validationFlags)
+	// A password policy without password columns applies to the columns hashed, as it would otherwise do nothing
+	if configInfo.Validation.hasPasswordPolicy() && len(configInfo.Validation.PasswordColumns) == 0 {
+		for _, column := range configInfo.Columns {
+			configInfo.Validation.PasswordColumns = append(configInfo.Validation.PasswordColumns, column.name())
+		}
+		if len(configInfo.Validation.PasswordColumns) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: the password policy needs password_column or a column to hash\n")
+			fmt.Fprintf(os.Stderr, UsageString)
+			os.Exit(1)
+		}
+	}
+	stepConfigs = append(stepConfigs, Steps...)
+	for _, stepConfig := range stepConfigs {
+		step, err := newTransformStep(stepConfig, configInfo.Scheme, configInfo.HashParams, configInfo.Rehash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintf(os.Stderr, UsageString)
+			os.Exit(1)
+		}
+		configInfo.Pipeline = append(configInfo.Pipeline, step)
+	}
+	protectSecrets(configInfo.Pipeline, configInfo.Validation.PasswordColumns)
 	return
 }
 
 // doHelp outputs detailed help message
 func doHelp() {
-	fmt.Printf("Usage csvHasher -input_file csv_file -output_file csv_file [-column_name column_name | -column_number column_number] [-hash_size 256 | 512]\n")
+	fmt.Printf("Usage csvHasher -input_file csv_file -output_file csv_file [-column_name column_name | -column_number column_number | -column name:scheme ...] [-no_header] [dialect options] [-transform yaml_file] [-step op=arguments ...] [validation options] [-reject_file csv_file] [-rehash] [-workers n] [-progress interval] [-hash_size 256 | 512] [-scheme scheme] [cost options]\n")
 	fmt.Printf("   csvHasher converts the specified column of a CSV file to SHA256 or SHA512 format usable as an ldap password\n")
 	fmt.Printf("   The format generated is consistent with https://docs.ldap.com/specs/draft-stroeder-hashed-userpassword-values-01.txt\n")
+	fmt.Printf("   -scheme selects another format:\n")
+	for _, name := range schemeNames() {
+		fmt.Printf("      %-14s %s\n", name, hashSchemes[name].description)
+	}
+	fmt.Printf("   The cost options are -salt_length, -pbkdf2_iterations, -bcrypt_cost, -scrypt_n, -scrypt_r, -scrypt_p,\n")
+	fmt.Printf("   -argon2_time, -argon2_memory (KiB) and -argon2_threads.\n")
+	fmt.Printf("   The dialect options are -delimiter, -comment, -lazy_quotes and -input_encoding for input_file, and\n")
+	fmt.Printf("   -output_delimiter and -output_encoding for output_file.  The encodings are:\n")
+	for _, name := range encodingNames() {
+		fmt.Printf("      %-14s %s\n", name, characterEncodings[name].description)
+	}
 
 	os.Exit(0)
 }
 
-// openInputFile returns a csv reader for the specified file if it exists
-func openInputFile(inputFileName string) (inputCsvReader *csv.Reader) {
-	f, err := os.Open(inputFileName)
+// openInputFile returns a csv reader for the specified file, or stdin for -, in the dialect given, if it exists
+func openInputFile(inputFileName string, dialect Dialect) (inputCsvReader *csv.Reader) {
+	f, err := openCompressed(inputFileName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening %s: %v \n ", inputFileName, err)
 		os.Exit(1)
 	}
-	inputCsvReader = csv.NewReader(f)
+	inputCsvReader = dialect.reader(f)
 	return
 }
 
-// openOutputFile returns a csv writer for the specified file if it can be created
-func openOutputFile(outputFileName string) (outputCsvWriter *csv.Writer) {
-	f, err := os.Create(outputFileName)
+// openOutputFile returns a csv writer for the specified file, or stdout for -, in the dialect given, if it can be
+// created, and the closer to close it with once the writer is flushed
+func openOutputFile(outputFileName string, dialect Dialect) (outputCsvWriter *csv.Writer, closer io.Closer) {
+	f, err := createCompressed(outputFileName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening %s: %v \n ", outputFileName, err)
 		os.Exit(1)
 	}
-	outputCsvWriter = csv.NewWriter(f)
+	outputCsvWriter, closer = dialect.writer(f)
 	return
 }
 
-// getColumnNumber looks for ColumnName in the header record
-func getColumnNumber(configInfo *ConfigInfo, record []string) {
-	for i, name := range record {
-		if name == configInfo.ColumnName {
-			configInfo.ColumnNumber = i
+// getColumnNumber looks for ColumnName in the header record, or checks the header has a column ColumnNumber when
+// the column is given by number
+func getColumnNumber(column *ColumnInfo, record []string) error {
+	if column.ColumnName == "" {
+		if column.ColumnNumber >= len(record) {
+			return fmt.Errorf("column %d not found, the header has %d columns", column.ColumnNumber+1, len(record))
 		}
+		return nil
 	}
-	return
+	if column.ColumnNumber = findColumn(record, column.ColumnName); column.ColumnNumber < 0 {
+		return fmt.Errorf("column %s not found in header %v", column.ColumnName, record)
+	}
+	return nil
 }
 
-// hash256SpecifiedColumn replaces the specified column with the SHA256 hash
-func hash256SpecifiedColumn(record []string, ColumnNumber int) {
-	if len(record) <= ColumnNumber {
-		fmt.Fprintf(os.Stderr, "Record does not contain at least %d columns: %v \n ", ColumnNumber, record)
-		os.Exit(1)
+// checkDuplicateColumns stops when the same column is to be hashed twice, which would hash the hash
+func checkDuplicateColumns(columns []ColumnInfo, header []string) {
+	seen := make(map[int]bool)
+	for _, column := range columns {
+		if seen[column.ColumnNumber] {
+			name := strconv.Itoa(column.ColumnNumber + 1)
+			if column.ColumnNumber < len(header) {
+				name = header[column.ColumnNumber]
+			}
+			fmt.Fprintf(os.Stderr, "Error: column %s is specified more than once\n", name)
+			os.Exit(1)
+		}
+		seen[column.ColumnNumber] = true
 	}
-	sum := sha256.Sum256([]byte(record[ColumnNumber]))
-	record[ColumnNumber] = "{SHA256}" + base64.StdEncoding.EncodeToString(sum[:])
 	return
 }
 
-// hash512SpecifiedColumn replaces the specified column with the SHA512 hash
-func hash512SpecifiedColumn(record []string, ColumnNumber int) {
+// hashSpecifiedColumn replaces the specified column with its hash
+func hashSpecifiedColumn(record []string, ColumnNumber int, hasher hasher) error {
 	if len(record) <= ColumnNumber {
-		fmt.Fprintf(os.Stderr, "Record does not contain at least %d columns: %v \n ", ColumnNumber, record)
-		os.Exit(1)
+		return fmt.Errorf("record does not contain at least %d columns", ColumnNumber+1)
 	}
-	sum := sha512.Sum512([]byte(record[ColumnNumber]))
-	record[ColumnNumber] = "{SHA512}" + base64.StdEncoding.EncodeToString(sum[:])
-	return
+	hashed, err := hasher.hash(record[ColumnNumber])
+	if err != nil {
+		return fmt.Errorf("error hashing column %d: %v", ColumnNumber+1, err)
+	}
+	record[ColumnNumber] = hashed
+	return nil
 }
@@ -0,0 +1,494 @@
+// The transform pipeline csvHasher runs over each record, configured by a YAML file given to -transform or by -step
+
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// StepConfig is one step of the transform pipeline.  Which fields are used depends on the Op:
+//
+//	trim       Columns (all columns when empty)
+//	lowercase  Columns
+//	rename     Columns to the names in To
+//	order      Columns, in the order given, dropping the rest
+//	drop       Columns
+//	split      Columns[0] on Separator into the columns in To
+//	join       Columns with Separator into To[0], skipping empty values
+//	default    Columns set to Value when empty
+//	hash       Columns with Scheme (defaults to -scheme)
+type StepConfig struct {
+	Op        string   `yaml:"op"`
+	Columns   []string `yaml:"columns"`
+	To        []string `yaml:"to"`
+	Separator string   `yaml:"separator"`
+	Value     string   `yaml:"value"`
+	Scheme    string   `yaml:"scheme"`
+}
+
+// TransformConfig is the YAML file given to -transform
+type TransformConfig struct {
+	Steps      []StepConfig     `yaml:"steps"`
+	Validation ValidationConfig `yaml:"validation"`
+}
+
+// transformStep is one step of the pipeline
+type transformStep interface {
+	// header finds the step's columns in the header record and returns the header record after the step
+	header(header []string) ([]string, error)
+	// apply returns the data record after the step
+	apply(record []string) ([]string, error)
+}
+
+// readTransformConfig reads the steps and validation of the YAML transform file
+func readTransformConfig(fileName string) (*TransformConfig, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config TransformConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", fileName, err)
+	}
+	return &config, nil
+}
+
+// stepList collects the repeated -step arguments
+type stepList []StepConfig
+
+func (s *stepList) String() string {
+	var ops []string
+	for _, step := range *s {
+		ops = append(ops, step.Op)
+	}
+	return strings.Join(ops, ",")
+}
+
+// Set parses a -step argument, op=arguments:
+//
+//	trim[=a,b]  lowercase=a,b  drop=a,b  order=a,b  rename=a:x,b:y
+//	split=a:x,y  join=a,b:x  default=a:value  hash=a,b[:scheme]
+//
+// split and join use a space as the separator.  Column names containing "," or ":" can only be used in a YAML file.
+func (s *stepList) Set(value string) error {
+	op, arguments, _ := strings.Cut(value, "=")
+	step := StepConfig{Op: strings.ToLower(op)}
+	list := func(value string) []string {
+		if value == "" {
+			return nil
+		}
+		return strings.Split(value, ",")
+	}
+	switch step.Op {
+	case "trim", "lowercase", "drop", "order":
+		step.Columns = list(arguments)
+	case "rename":
+		for _, pair := range list(arguments) {
+			from, to, found := strings.Cut(pair, ":")
+			if !found {
+				return fmt.Errorf("rename expects from:to pairs, not %s", pair)
+			}
+			step.Columns = append(step.Columns, from)
+			step.To = append(step.To, to)
+		}
+	case "split", "join":
+		from, to, found := strings.Cut(arguments, ":")
+		if !found {
+			return fmt.Errorf("%s expects columns:columns, not %s", step.Op, arguments)
+		}
+		step.Columns, step.To = list(from), list(to)
+	case "default":
+		column, defaultValue, found := strings.Cut(arguments, ":")
+		if !found {
+			return fmt.Errorf("default expects column:value, not %s", arguments)
+		}
+		step.Columns, step.Value = []string{column}, defaultValue
+	case "hash":
+		columns := arguments
+		if i := strings.LastIndex(arguments, ":"); i >= 0 {
+			columns, step.Scheme = arguments[:i], arguments[i+1:]
+		}
+		step.Columns = list(columns)
+	}
+	*s = append(*s, step)
+	return nil
+}
+
+// newTransformStep creates the pipeline step for a StepConfig
+func newTransformStep(config StepConfig, defaultScheme string, params HashParams, rehash bool) (transformStep, error) {
+	need := func(what string, count int, names []string) error {
+		if len(names) < count {
+			return fmt.Errorf("%s step needs at least %d %s", config.Op, count, what)
+		}
+		return nil
+	}
+	var err error
+	switch config.Op {
+	case "trim":
+		return &valueStep{columns: config.Columns, all: len(config.Columns) == 0, transform: strings.TrimSpace}, nil
+	case "lowercase":
+		err = need("columns", 1, config.Columns)
+		return &valueStep{columns: config.Columns, transform: strings.ToLower}, err
+	case "rename":
+		if err = need("columns", 1, config.Columns); err == nil && len(config.To) != len(config.Columns) {
+			err = fmt.Errorf("rename step needs a new name for each of its columns")
+		}
+		return &renameStep{columns: config.Columns, to: config.To}, err
+	case "order":
+		err = need("columns", 1, config.Columns)
+		return &orderStep{columns: config.Columns}, err
+	case "drop":
+		err = need("columns", 1, config.Columns)
+		return &dropStep{columns: config.Columns}, err
+	case "split":
+		if err = need("columns", 1, config.Columns); err == nil {
+			err = need("columns to split into", 2, config.To)
+		}
+		return &splitStep{columns: config.Columns, to: config.To, separator: separatorOrSpace(config.Separator)}, err
+	case "join":
+		if err = need("columns", 2, config.Columns); err == nil {
+			err = need("column to join into", 1, config.To)
+		}
+		return &joinStep{columns: config.Columns, to: config.To, separator: separatorOrSpace(config.Separator)}, err
+	case "default":
+		err = need("columns", 1, config.Columns)
+		return &defaultStep{columns: config.Columns, value: config.Value}, err
+	case "hash":
+		if err = need("columns", 1, config.Columns); err != nil {
+			return nil, err
+		}
+		scheme := config.Scheme
+		if scheme == "" {
+			scheme = defaultScheme
+		}
+		step := &hashStep{rehash: rehash}
+		for _, name := range config.Columns {
+			column := ColumnInfo{ColumnName: name, Scheme: scheme}
+			if column.Hasher, err = newHasher(scheme, params); err != nil {
+				return nil, err
+			}
+			step.columns = append(step.columns, &column)
+		}
+		return step, nil
+	}
+	return nil, fmt.Errorf("unknown transform step %q, expected trim, lowercase, rename, order, drop, split, join, default or hash", config.Op)
+}
+
+// protectSecrets keeps the steps transforming every column away from the columns hashed anywhere in the pipeline and
+// the passwordColumns, as a password with spaces trimmed off is no longer the password the user logs in with
+func protectSecrets(pipeline []transformStep, passwordColumns []string) {
+	secrets := append([]string(nil), passwordColumns...)
+	for _, step := range pipeline {
+		if hashStep, ok := step.(*hashStep); ok {
+			for _, column := range hashStep.columns {
+				secrets = append(secrets, column.name())
+			}
+		}
+	}
+	for _, step := range pipeline {
+		if valueStep, ok := step.(*valueStep); ok && valueStep.all {
+			valueStep.skip = secrets
+		}
+	}
+}
+
+func separatorOrSpace(separator string) string {
+	if separator == "" {
+		return " "
+	}
+	return separator
+}
+
+// findColumn returns the index of the named column in the header record, or -1 if there is none.  #number names the
+// column with that number, starting at 1.  Names that don't match exactly are matched ignoring case and surrounding
+// spaces, as HR exports rarely agree on how their headers are written.
+func findColumn(header []string, name string) int {
+	if strings.HasPrefix(name, "#") {
+		if number, err := strconv.Atoi(name[1:]); err == nil && number >= 1 && number <= len(header) {
+			return number - 1
+		}
+		return -1
+	}
+	for i, column := range header {
+		if column == name {
+			return i
+		}
+	}
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), strings.TrimSpace(name)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// findColumns returns the indexes of the named columns in the header record
+func findColumns(header []string, names []string) ([]int, error) {
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		if indexes[i] = findColumn(header, name); indexes[i] < 0 {
+			return nil, fmt.Errorf("column %s not found in header %v", name, header)
+		}
+	}
+	return indexes, nil
+}
+
+// findOrAddColumn returns the index of the named column, adding it to the end of the header when there is none
+func findOrAddColumn(header []string, name string) ([]string, int) {
+	if i := findColumn(header, name); i >= 0 {
+		return header, i
+	}
+	return append(header, name), len(header)
+}
+
+// widen pads the record with empty values to the width of the header
+func widen(record []string, width int) []string {
+	for len(record) < width {
+		record = append(record, "")
+	}
+	return record
+}
+
+// valueStep replaces the values of columns, or of every column but those in skip, by a function of them
+type valueStep struct {
+	columns   []string
+	all       bool
+	skip      []string
+	transform func(string) string
+	indexes   []int
+}
+
+func (s *valueStep) header(header []string) ([]string, error) {
+	if s.all {
+		skipped := make(map[int]bool)
+		for _, name := range s.skip {
+			if i := findColumn(header, name); i >= 0 {
+				skipped[i] = true
+			}
+		}
+		s.indexes = nil
+		for i := range header {
+			if !skipped[i] {
+				s.indexes = append(s.indexes, i)
+			}
+		}
+		return header, nil
+	}
+	var err error
+	s.indexes, err = findColumns(header, s.columns)
+	return header, err
+}
+
+func (s *valueStep) apply(record []string) ([]string, error) {
+	for _, i := range s.indexes {
+		if i < len(record) {
+			record[i] = s.transform(record[i])
+		}
+	}
+	return record, nil
+}
+
+// renameStep renames columns in the header
+type renameStep struct {
+	columns []string
+	to      []string
+}
+
+func (s *renameStep) header(header []string) ([]string, error) {
+	indexes, err := findColumns(header, s.columns)
+	if err != nil {
+		return nil, err
+	}
+	renamed := append([]string(nil), header...)
+	for i, index := range indexes {
+		renamed[index] = s.to[i]
+	}
+	return renamed, nil
+}
+
+func (s *renameStep) apply(record []string) ([]string, error) {
+	return record, nil
+}
+
+// orderStep outputs only the listed columns, in the order listed
+type orderStep struct {
+	columns []string
+	indexes []int
+}
+
+func (s *orderStep) header(header []string) ([]string, error) {
+	var err error
+	if s.indexes, err = findColumns(header, s.columns); err != nil {
+		return nil, err
+	}
+	return s.apply(header)
+}
+
+func (s *orderStep) apply(record []string) ([]string, error) {
+	ordered := make([]string, len(s.indexes))
+	for i, index := range s.indexes {
+		if index < len(record) {
+			ordered[i] = record[index]
+		}
+	}
+	return ordered, nil
+}
+
+// dropStep removes columns
+type dropStep struct {
+	columns []string
+	drop    map[int]bool
+}
+
+func (s *dropStep) header(header []string) ([]string, error) {
+	indexes, err := findColumns(header, s.columns)
+	if err != nil {
+		return nil, err
+	}
+	s.drop = make(map[int]bool)
+	for _, index := range indexes {
+		s.drop[index] = true
+	}
+	return s.apply(header)
+}
+
+func (s *dropStep) apply(record []string) ([]string, error) {
+	var kept []string
+	for i, value := range record {
+		if !s.drop[i] {
+			kept = append(kept, value)
+		}
+	}
+	return kept, nil
+}
+
+// splitStep splits a column, such as a full name, into several.  The last column gets the remainder of the value.
+type splitStep struct {
+	columns   []string
+	to        []string
+	separator string
+	source    int
+	targets   []int
+	width     int
+}
+
+func (s *splitStep) header(header []string) ([]string, error) {
+	if s.source = findColumn(header, s.columns[0]); s.source < 0 {
+		return nil, fmt.Errorf("column %s not found in header %v", s.columns[0], header)
+	}
+	header = append([]string(nil), header...)
+	s.targets = make([]int, len(s.to))
+	for i, name := range s.to {
+		header, s.targets[i] = findOrAddColumn(header, name)
+	}
+	s.width = len(header)
+	return header, nil
+}
+
+func (s *splitStep) apply(record []string) ([]string, error) {
+	record = widen(record, s.width)
+	parts := strings.SplitN(strings.TrimSpace(record[s.source]), s.separator, len(s.targets))
+	for i, target := range s.targets {
+		value := ""
+		if i < len(parts) {
+			value = strings.TrimSpace(parts[i])
+		}
+		record[target] = value
+	}
+	return record, nil
+}
+
+// joinStep joins columns, such as given and family names, into one, skipping empty values
+type joinStep struct {
+	columns   []string
+	to        []string
+	separator string
+	sources   []int
+	target    int
+	width     int
+}
+
+func (s *joinStep) header(header []string) ([]string, error) {
+	var err error
+	if s.sources, err = findColumns(header, s.columns); err != nil {
+		return nil, err
+	}
+	header, s.target = findOrAddColumn(append([]string(nil), header...), s.to[0])
+	s.width = len(header)
+	return header, nil
+}
+
+func (s *joinStep) apply(record []string) ([]string, error) {
+	record = widen(record, s.width)
+	var values []string
+	for _, source := range s.sources {
+		if value := strings.TrimSpace(record[source]); value != "" {
+			values = append(values, value)
+		}
+	}
+	record[s.target] = strings.Join(values, s.separator)
+	return record, nil
+}
+
+// defaultStep sets empty values, adding the columns when the input doesn't have them
+type defaultStep struct {
+	columns []string
+	value   string
+	targets []int
+	width   int
+}
+
+func (s *defaultStep) header(header []string) ([]string, error) {
+	header = append([]string(nil), header...)
+	s.targets = make([]int, len(s.columns))
+	for i, name := range s.columns {
+		header, s.targets[i] = findOrAddColumn(header, name)
+	}
+	s.width = len(header)
+	return header, nil
+}
+
+func (s *defaultStep) apply(record []string) ([]string, error) {
+	record = widen(record, s.width)
+	for _, target := range s.targets {
+		if record[target] == "" {
+			record[target] = s.value
+		}
+	}
+	return record, nil
+}
+
+// hashStep hashes columns, each with its own scheme, found in the header by getColumnNumber.  Values that are already
+// hashed are passed through unless rehash is set, so runs can be repeated over partially processed files.
+type hashStep struct {
+	columns       []*ColumnInfo
+	rehash        bool
+	passedThrough int64 // updated atomically, as the workers share the step
+}
+
+func (s *hashStep) header(header []string) ([]string, error) {
+	for _, column := range s.columns {
+		if err := getColumnNumber(column, header); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+func (s *hashStep) apply(record []string) ([]string, error) {
+	for _, column := range s.columns {
+		if !s.rehash && column.ColumnNumber < len(record) && isHashed(record[column.ColumnNumber]) {
+			atomic.AddInt64(&s.passedThrough, 1)
+			continue
+		}
+		if err := hashSpecifiedColumn(record, column.ColumnNumber, column.Hasher); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
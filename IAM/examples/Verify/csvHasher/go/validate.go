@@ -0,0 +1,250 @@
+// The validation csvHasher applies to each record before transforming it, and the reject file bad records go to
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ValidationConfig holds the checks made on each record, given by flags or in the validation section of the
+// -transform YAML file.  The columns are those of the input file.
+type ValidationConfig struct {
+	Required          []string `yaml:"required"`
+	EmailColumns      []string `yaml:"email"`
+	UniqueColumns     []string `yaml:"unique"`
+	PasswordColumns   []string `yaml:"password"`
+	PasswordMinLength int      `yaml:"password_min_length"`
+	PasswordMaxLength int      `yaml:"password_max_length"`
+	PasswordClasses   int      `yaml:"password_classes"`
+}
+
+// merge adds the checks given by flags to those of the YAML file, the flags taking precedence for the password policy
+func (v *ValidationConfig) merge(flags ValidationConfig) {
+	v.Required = append(v.Required, flags.Required...)
+	v.EmailColumns = append(v.EmailColumns, flags.EmailColumns...)
+	v.UniqueColumns = append(v.UniqueColumns, flags.UniqueColumns...)
+	v.PasswordColumns = append(v.PasswordColumns, flags.PasswordColumns...)
+	if flags.PasswordMinLength != 0 {
+		v.PasswordMinLength = flags.PasswordMinLength
+	}
+	if flags.PasswordMaxLength != 0 {
+		v.PasswordMaxLength = flags.PasswordMaxLength
+	}
+	if flags.PasswordClasses != 0 {
+		v.PasswordClasses = flags.PasswordClasses
+	}
+}
+
+// enabled reports whether any checks beyond the column count are configured
+func (v *ValidationConfig) enabled() bool {
+	return len(v.Required) > 0 || len(v.EmailColumns) > 0 || len(v.UniqueColumns) > 0 || len(v.PasswordColumns) > 0
+}
+
+// hasPasswordPolicy reports whether any of the password policy is configured
+func (v *ValidationConfig) hasPasswordPolicy() bool {
+	return v.PasswordMinLength != 0 || v.PasswordMaxLength != 0 || v.PasswordClasses != 0
+}
+
+// splitList splits a comma separated flag value
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// The kinds of rejection counted in the summary
+const (
+	rejectMalformed   = "malformed CSV"
+	rejectColumnCount = "wrong number of columns"
+	rejectRequired    = "required field empty"
+	rejectEmail       = "invalid email address"
+	rejectDuplicate   = "duplicate value"
+	rejectPassword    = "password policy"
+	rejectTransform   = "transform failed"
+)
+
+// validator checks records against a ValidationConfig
+type validator struct {
+	config    ValidationConfig
+	rehash    bool // already hashed values are hashed again, so are held to the password policy
+	width     int
+	required  []int
+	emails    []int
+	unique    []int
+	passwords []int
+	header    []string
+	seen      []map[string]int // the record number each value of the unique columns was first seen on
+}
+
+// setHeader finds the columns of the checks in the header record
+func (v *validator) setHeader(header []string) error {
+	v.width = len(header)
+	v.header = header
+	var err error
+	if v.required, err = findColumns(header, v.config.Required); err != nil {
+		return err
+	}
+	if v.emails, err = findColumns(header, v.config.EmailColumns); err != nil {
+		return err
+	}
+	if v.unique, err = findColumns(header, v.config.UniqueColumns); err != nil {
+		return err
+	}
+	if v.passwords, err = findColumns(header, v.config.PasswordColumns); err != nil {
+		return err
+	}
+	v.seen = make([]map[string]int, len(v.unique))
+	for i := range v.seen {
+		v.seen[i] = make(map[string]int)
+	}
+	return nil
+}
+
+// validate returns the kind of and reason for rejecting the record, or "" when it passes every check
+func (v *validator) validate(recordNumber int, record []string) (kind string, reason string) {
+	if len(record) != v.width {
+		return rejectColumnCount, fmt.Sprintf("record has %d columns, the header has %d", len(record), v.width)
+	}
+	for _, i := range v.required {
+		if strings.TrimSpace(record[i]) == "" {
+			return rejectRequired, fmt.Sprintf("%s is empty", v.header[i])
+		}
+	}
+	for _, i := range v.emails {
+		value := strings.TrimSpace(record[i])
+		if value == "" {
+			continue
+		}
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return rejectEmail, fmt.Sprintf("%s is not a valid email address", v.header[i])
+		}
+	}
+	for _, i := range v.passwords {
+		if !v.rehash && isHashed(record[i]) {
+			continue
+		}
+		if reason := v.checkPassword(record[i]); reason != "" {
+			return rejectPassword, fmt.Sprintf("%s %s", v.header[i], reason)
+		}
+	}
+	// Unique values are only recorded once the record has passed the other checks, so a corrected copy of a rejected
+	// record isn't taken for a duplicate
+	for j, i := range v.unique {
+		value := strings.ToLower(strings.TrimSpace(record[i]))
+		if first, found := v.seen[j][value]; found && value != "" {
+			return rejectDuplicate, fmt.Sprintf("%s duplicates record %d", v.header[i], first)
+		}
+	}
+	for j, i := range v.unique {
+		v.seen[j][strings.ToLower(strings.TrimSpace(record[i]))] = recordNumber
+	}
+	return "", ""
+}
+
+// checkPassword returns why the password doesn't meet the policy, or "" when it does
+func (v *validator) checkPassword(password string) string {
+	length := len([]rune(password))
+	if length < v.config.PasswordMinLength {
+		return fmt.Sprintf("is shorter than %d characters", v.config.PasswordMinLength)
+	}
+	if v.config.PasswordMaxLength > 0 && length > v.config.PasswordMaxLength {
+		return fmt.Sprintf("is longer than %d characters", v.config.PasswordMaxLength)
+	}
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < v.config.PasswordClasses {
+		return fmt.Sprintf("has fewer than %d of lower case, upper case, digits and other characters", v.config.PasswordClasses)
+	}
+	return ""
+}
+
+// rejects writes the rejected records, as read, to the reject file with the reason in an extra column, and counts
+// them for the summary.  Without a reject file only the record numbers and reasons are reported, on stderr, so the
+// clear text passwords aren't echoed.
+type rejects struct {
+	writer *csv.Writer
+	closer io.Closer
+	counts map[string]int
+	total  int
+}
+
+// openRejects returns rejects writing to the named file, compressed according to its name, in the dialect given, or to
+// stderr when the name is ""
+func openRejects(rejectFileName string, dialect Dialect) *rejects {
+	r := &rejects{counts: make(map[string]int)}
+	if rejectFileName != "" {
+		f, err := createCompressed(rejectFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s: %v \n ", rejectFileName, err)
+			os.Exit(1)
+		}
+		r.writer, r.closer = dialect.writer(f)
+	}
+	return r
+}
+
+// writeHeader writes the header record of the input file, with the reason column, to the reject file
+func (r *rejects) writeHeader(header []string) error {
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.Write(append(append([]string(nil), header...), "reason"))
+}
+
+// reject records a rejected record
+func (r *rejects) reject(recordNumber int, record []string, kind string, reason string) error {
+	r.counts[kind]++
+	r.total++
+	if r.writer == nil {
+		fmt.Fprintf(os.Stderr, "Rejected record %d: %s\n", recordNumber, reason)
+		return nil
+	}
+	return r.writer.Write(append(append([]string(nil), record...), reason))
+}
+
+// close flushes the reject file
+func (r *rejects) close() error {
+	if r.writer == nil {
+		return nil
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		return err
+	}
+	return r.closer.Close()
+}
+
+// printSummary reports the numbers of records written and rejected, by reason, and of values already hashed, on stderr
+func (r *rejects) printSummary(read int, written int, passedThrough int64) {
+	fmt.Fprintf(os.Stderr, "Records read: %d, written: %d, rejected: %d\n", read, written, r.total)
+	if passedThrough > 0 {
+		fmt.Fprintf(os.Stderr, "Values already hashed and passed through: %d\n", passedThrough)
+	}
+	var kinds []string
+	for kind := range r.counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(os.Stderr, "   %-24s %d\n", kind+":", r.counts[kind])
+	}
+}
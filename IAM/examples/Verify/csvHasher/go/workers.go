@@ -0,0 +1,177 @@
+// The worker pool csvHasher runs the transform pipeline on, so expensive schemes use every core
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// batchSize is the number of records handed to a worker at a time
+const batchSize = 256
+
+// batchesPerWorker is the number of batches that can be in flight, read but not yet written, for each worker.  This
+// bounds the memory used however large the file, and however far a slow batch holds up those after it.
+const batchesPerWorker = 4
+
+// recordResult is a data record after the pipeline, or the kind of and reason for rejecting it
+type recordResult struct {
+	number   int
+	record   []string
+	original []string // the record as read, kept for the reject file
+	kind     string
+	reason   string
+}
+
+// recordBatch is a run of consecutive records, numbered in the order they were read
+type recordBatch struct {
+	sequence int
+	results  []recordResult
+}
+
+// processRecords validates the data records in the order read, runs the pipeline on them with workers goroutines
+// and writes the results in the order read, returning the numbers of records read and written.  first is the first
+// data record when the file has no header, and is otherwise nil.
+func processRecords(configInfo *ConfigInfo, first []string, reader *csv.Reader, writer *csv.Writer, rejected *rejects, validator *validator) (read int, written int) {
+	workers := configInfo.Workers
+	batches := make(chan *recordBatch, workers)
+	results := make(chan *recordBatch, workers)
+	// A token is taken for each batch read and given back once it has been written
+	tokens := make(chan struct{}, workers*batchesPerWorker)
+
+	go func() {
+		defer close(batches)
+		recordNumber := 1 // the header
+		if first != nil {
+			recordNumber = 0
+		}
+		for sequence := 0; ; sequence++ {
+			tokens <- struct{}{}
+			batch := &recordBatch{sequence: sequence}
+			for len(batch.results) < batchSize {
+				var record []string
+				var err error
+				if first != nil {
+					record, first = first, nil
+				} else if record, err = reader.Read(); err == io.EOF {
+					break
+				}
+				recordNumber++
+				// A line that isn't valid CSV is rejected like a bad record, the reader carrying on after it, as the
+				// output file would otherwise be left part written
+				var parseError *csv.ParseError
+				if errors.As(err, &parseError) {
+					reason := fmt.Sprintf("line %d is not valid CSV: %v", parseError.StartLine, parseError.Err)
+					batch.results = append(batch.results,
+						recordResult{number: recordNumber, record: make([]string, validator.width), kind: rejectMalformed, reason: reason})
+					continue
+				}
+				if err != nil {
+					log.Fatalln("error reading record from csv:", err)
+				}
+				// Validation runs here, in the order read, so duplicates are found against the records before them
+				result := recordResult{number: recordNumber, record: record}
+				result.kind, result.reason = validator.validate(recordNumber, record)
+				batch.results = append(batch.results, result)
+			}
+			if len(batch.results) == 0 {
+				return
+			}
+			batches <- batch
+		}
+	}()
+
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range batches {
+				for i := range batch.results {
+					result := &batch.results[i]
+					if result.kind != "" {
+						result.original = result.record
+						continue
+					}
+					result.original = append([]string(nil), result.record...)
+					var err error
+					for _, step := range configInfo.Pipeline {
+						if result.record, err = step.apply(result.record); err != nil {
+							result.kind, result.reason = rejectTransform, err.Error()
+							break
+						}
+					}
+				}
+				results <- batch
+			}
+			done <- struct{}{}
+		}()
+	}
+	go func() {
+		for i := 0; i < workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	var progress <-chan time.Time
+	if configInfo.Progress > 0 {
+		ticker := time.NewTicker(configInfo.Progress)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+	started := time.Now()
+	pending := make(map[int]*recordBatch)
+	next := 0
+	for {
+		select {
+		case batch, ok := <-results:
+			if !ok {
+				if configInfo.Progress > 0 {
+					printProgress(read, started)
+				}
+				return read, written
+			}
+			pending[batch.sequence] = batch
+			for pending[next] != nil {
+				batch := pending[next]
+				delete(pending, next)
+				next++
+				written += writeBatch(batch, writer, rejected)
+				read += len(batch.results)
+				<-tokens
+			}
+		case <-progress:
+			printProgress(read, started)
+		}
+	}
+}
+
+// writeBatch writes the records of a batch to the output file and the rejected ones to the reject file, returning
+// the number written to the output file
+func writeBatch(batch *recordBatch, writer *csv.Writer, rejected *rejects) (written int) {
+	for _, result := range batch.results {
+		// Bad records go to the reject file as they were read, rather than stopping part way through the output
+		if result.kind != "" {
+			if err := rejected.reject(result.number, result.original, result.kind, result.reason); err != nil {
+				log.Fatalln("error writing record to reject csv:", err)
+			}
+			continue
+		}
+		if err := writer.Write(result.record); err != nil {
+			log.Fatalln("error writing record to csv:", err)
+		}
+		written++
+	}
+	return
+}
+
+// printProgress reports the number of records processed and the rate on stderr
+func printProgress(records int, started time.Time) {
+	elapsed := time.Since(started)
+	fmt.Fprintf(os.Stderr, "Processed %d records in %s, %.0f records/sec\n", records, elapsed.Round(time.Second),
+		float64(records)/elapsed.Seconds())
+}
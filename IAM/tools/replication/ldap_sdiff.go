@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	_ "github.com/ibmdb/go_ibm_db"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
 // Type for entry information
@@ -14,96 +20,672 @@ type ldapEntry struct {
 	dn_trunc         string
 	dn               string
 	modify_timestamp string
+	attributes       map[string]string // canonical values of the attributes of the profile compared
+	group            bool              // has a group object class, only read when the members are compared
+	err              error             // set on the last entry sent by a source that failed
 }
 
 var verbose = 0
 
-func listAllEntries(DBconn *sql.DB, schema string, out chan<- ldapEntry) {
+// Exit codes, so the comparison can gate scripted checks.
+const (
+	exitConsistent       = 0
+	exitError            = 1
+	exitDifferencesFound = 2
+	exitSecurityDiverged = 3
+)
+
+// entryBuffer is the number of entries each reader can get ahead of the comparison, so one slow server doesn't
+// hold up reading the others.
+const entryBuffer = 1000
+
+// keyRange is a range of dn_trunc values from after (exclusive) up to upTo (inclusive).  An empty bound leaves
+// that end of the range open.
+type keyRange struct {
+	after string
+	upTo  string
+}
+
+// where returns the SQL condition selecting the range, with its parameters.
+func (r keyRange) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if r.after != "" {
+		conditions = append(conditions, "dn_trunc > ?")
+		args = append(args, r.after)
+	}
+	if r.upTo != "" {
+		conditions = append(conditions, "dn_trunc <= ?")
+		args = append(args, r.upTo)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conditions, " and ") + " ", args
+}
+
+// contains reports whether the dn_trunc value falls within the range.
+func (r keyRange) contains(dn_trunc string) bool {
+	return (r.after == "" || dn_trunc > r.after) && (r.upTo == "" || dn_trunc <= r.upTo)
+}
+
+// queryContext bounds a single query by the query timeout, when one is set.
+func queryContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sendEntry passes an entry on to the comparison, returning false once the comparison has been cancelled.
+func sendEntry(ctx context.Context, out chan<- ldapEntry, entry ldapEntry) bool {
+	select {
+	case out <- entry:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// listAllEntries sends every entry in the range to out in dn_trunc order.  A failure is sent as a final entry
+// carrying the error, so it can't be mistaken for the end of the data.  The timeout covers running the query up
+// to the first row, the rows are then read for as long as the comparison takes.  With members the entries with a
+// group object class are marked as groups.
+func listAllEntries(ctx context.Context, DBconn *sql.DB, schema string, r keyRange, timeout time.Duration, members bool, out chan<- ldapEntry) {
 	defer close(out)
 	listAllEntries := []string{
-		"select dn_trunc, modify_timestamp ",
-		"from %s.ldap_entry order by dn_trunc "}
+		"select dn_trunc, dn, char(modify_timestamp - current timezone), %s ", // Return timestamp in UTC format
+		"from %s.ldap_entry e %s order by dn_trunc "}
 	listAllEntriesSQLTemplate := strings.Join(listAllEntries, "")
-	listAllEntriesSQL := fmt.Sprintf(listAllEntriesSQLTemplate, schema)
-	statement, err := DBconn.Prepare(listAllEntriesSQL)
+	groupColumn := "0"
+	if members {
+		groupColumn = fmt.Sprintf("case when exists (select 1 from %s.objectclass o "+
+			"where o.eid = e.eid and upper(o.objectclass) in ('%s')) then 1 else 0 end",
+			schema, strings.ToUpper(strings.Join(groupObjectClasses, "', '")))
+	}
+	where, args := r.where()
+	listAllEntriesSQL := fmt.Sprintf(listAllEntriesSQLTemplate, groupColumn, schema, where)
+	queryCtx, cancelQuery := context.WithCancel(ctx)
+	defer cancelQuery()
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancelQuery)
+	}
+	statement, err := DBconn.PrepareContext(queryCtx, listAllEntriesSQL)
 	if err != nil {
-		fmt.Println("Error on Prepare: ", err.Error())
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Prepare: %v", err)})
 		return
 	}
-	rows, err := statement.Query()
+	defer statement.Close()
+	rows, err := statement.QueryContext(queryCtx, args...)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			rows.Close()
+		}
+		err = fmt.Errorf("no rows returned within %v", timeout)
+	}
 	if err != nil {
-		fmt.Println("Error on Query: ", err.Error())
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Query: %v", err)})
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var dn_trunc, modify_timestamp string
-		err = rows.Scan(&dn_trunc, &modify_timestamp)
+		var dn_trunc, dn, modify_timestamp string
+		var group int
+		err = rows.Scan(&dn_trunc, &dn, &modify_timestamp, &group)
 		if err != nil {
-			fmt.Println("Error on Scan: ", err.Error())
+			sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Scan: %v", err)})
+			return
+		}
+		if !sendEntry(ctx, out, ldapEntry{dn_trunc: dn_trunc, dn: dn, modify_timestamp: normalizeTimestamp(modify_timestamp), group: group == 1}) {
 			return
 		}
-		out <- ldapEntry{dn_trunc, dn_trunc, modify_timestamp}
 	}
-	return
+	if err := rows.Err(); err != nil {
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Fetch: %v", err)})
+	}
+}
+
+// lookupEntry fetches the current modify_timestamp of a single entry, returning "" when it does not exist.
+func lookupEntry(ctx context.Context, DBconn *sql.DB, schema string, dn string) (string, error) {
+	lookupEntrySQL := fmt.Sprintf("select char(modify_timestamp - current timezone) from %s.ldap_entry where dn_trunc = ?", schema)
+	var modify_timestamp string
+	err := DBconn.QueryRowContext(ctx, lookupEntrySQL, dn).Scan(&modify_timestamp)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return normalizeTimestamp(modify_timestamp), err
+}
+
+// timestampLayouts are the formats modify timestamps are accepted in: as returned through database/sql, DB2
+// character format and LDAP generalized time.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02-15.04.05",
+	"2006-01-02 15:04:05",
+	"20060102150405Z0700",
+}
+
+// parseTimestamp converts a modify timestamp to a time, assuming UTC where no zone is given.
+func parseTimestamp(timestamp string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", timestamp)
+}
+
+// unknownTimestamp stands in for the timestamp of entries read over LDAP or from LDIF without a modifyTimestamp,
+// as "" would mark them missing.  It takes no part in choosing the expected timestamp, and entries held everywhere
+// but without a timestamp on some server are reported as not comparable rather than as mismatches.
+const unknownTimestamp = "unknown"
+
+// normalizeTimestamp puts a modify timestamp in a single UTC format, so the same time read from DB2 and over LDAP
+// compares equal.  Timestamps that can't be parsed are left as they are.
+func normalizeTimestamp(timestamp string) string {
+	t, err := parseTimestamp(timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
 }
 
-func compareAllEntryModifyTimestamps(firstDB *sql.DB, secondDB *sql.DB, schema1 string, schema2 string) error {
-	fmt.Println("Reporting dn_trunc and modify_timestamp for any conflicting entries")
-	fmt.Println("-------------------------------------------------------------------")
+// inFlightRules decide when a difference is expected replication lag rather than a real divergence.
+type inFlightRules struct {
+	tolerance time.Duration // timestamps this close together are treated as lag
+	cutoff    time.Time     // entries modified after this are still being replicated
+}
 
-	ldap1Entries := make(chan ldapEntry)
-	ldap2Entries := make(chan ldapEntry)
+// inFlight reports whether the timestamps seen for an entry can be explained by changes still replicating.
+func (r inFlightRules) inFlight(timestamps []string) bool {
+	var oldest, newest time.Time
+	missing := false
+	for _, timestamp := range timestamps {
+		if timestamp == "" {
+			missing = true
+			continue
+		}
+		if timestamp == unknownTimestamp {
+			continue
+		}
+		t, err := parseTimestamp(timestamp)
+		if err != nil {
+			return false
+		}
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+		if newest.IsZero() || t.After(newest) {
+			newest = t
+		}
+	}
+	if !r.cutoff.IsZero() && newest.After(r.cutoff) {
+		return true
+	}
+	return !missing && r.tolerance > 0 && newest.Sub(oldest) <= r.tolerance
+}
 
-	go listAllEntries(firstDB, schema1, ldap1Entries)
-	go listAllEntries(secondDB, schema2, ldap2Entries)
+// expectedValue returns the value held by most servers, with ties going to the greatest, which for timestamps is
+// the newest.
+func expectedValue(counts map[string]int) string {
+	expected := ""
+	for value, count := range counts {
+		if count > counts[expected] || (count == counts[expected] && value > expected) {
+			expected = value
+		}
+	}
+	return expected
+}
 
-	ldap1Entry := <-ldap1Entries
-	ldap2Entry := <-ldap2Entries
+// classifyValues works out whether the values seen for a name on each server, "" where a server doesn't have it,
+// are consistent.
+func classifyValues(name string, values []string) (difference, bool) {
+	counts := make(map[string]int)
+	missing := false
+	for _, value := range values {
+		if value == "" {
+			missing = true
+			continue
+		}
+		counts[value]++
+	}
+	d := difference{dn: name, timestamps: values, expected: expectedValue(counts)}
+	switch {
+	case missing:
+		d.kind = missingEntry
+	case len(counts) > 1:
+		d.kind = timestampMismatch
+	default:
+		return d, false
+	}
+	return d, true
+}
 
-	for ldap1Entry.dn_trunc != "" && ldap2Entry.dn_trunc != "" {
-		if verbose > 1 {
-			fmt.Println("ldap1Entry: ", ldap1Entry.dn_trunc)
-			fmt.Println("ldap2Entry: ", ldap2Entry.dn_trunc)
+// classifyEntry works out whether the modify_timestamps seen for a DN on each server are consistent.  The
+// expected value is the one held by most servers, with ties going to the newest timestamp.
+func classifyEntry(dn string, timestamps []string, rules inFlightRules) (difference, bool) {
+	counts := make(map[string]int)
+	missing, unknown := false, false
+	for _, timestamp := range timestamps {
+		if timestamp == "" {
+			missing = true
+			continue
 		}
-		switch {
-		case ldap1Entry.dn_trunc == ldap2Entry.dn_trunc:
-			if ldap1Entry.modify_timestamp != ldap2Entry.modify_timestamp {
-				fmt.Printf("Mismatching timestamps for %s: %s != %s\n", ldap1Entry.dn_trunc, ldap1Entry.modify_timestamp, ldap2Entry.modify_timestamp)
+		if timestamp == unknownTimestamp {
+			unknown = true
+			continue
+		}
+		counts[timestamp]++
+	}
+	d := difference{dn: dn, timestamps: timestamps, expected: expectedValue(counts)}
+	switch {
+	case missing:
+		d.kind = missingEntry
+	case len(counts) > 1:
+		d.kind = timestampMismatch
+	case unknown:
+		d.kind = notComparable
+	default:
+		return d, false
+	}
+	if d.kind != notComparable && rules.inFlight(timestamps) {
+		d.kind = changeInFlight
+	}
+	return d, true
+}
+
+// recheckDifferences waits for delay and then looks each flagged DN up again on every server.  Entries that have
+// converged in the meantime are dropped, the rest are classified again against a cutoff of the recheck time.
+func recheckDifferences(ctx context.Context, servers []entrySource, flagged []difference, options compareOptions, summary *diffSummary) ([]difference, error) {
+	if verbose > 0 {
+		fmt.Fprintf(os.Stderr, "Rechecking %d entries in %v\n", len(flagged), options.recheckDelay)
+	}
+	select {
+	case <-time.After(options.recheckDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rules := options.rules
+	rules.cutoff = time.Now().UTC()
+
+	var confirmed []difference
+	for _, d := range flagged {
+		timestamps := make([]string, len(servers))
+		for i, server := range servers {
+			timestamp, current, err := server.lookupEntry(ctx, d.dn, d.fullDN)
+			if err != nil {
+				return nil, fmt.Errorf("Error on Query: %v", err)
 			}
-			ldap1Entry = <-ldap1Entries
-			ldap2Entry = <-ldap2Entries
+			if !current {
+				// An export doesn't change, so the timestamp it was compared with is kept.
+				timestamp = d.timestamps[i]
+			}
+			timestamps[i] = timestamp
+		}
+		if recheck, found := classifyEntry(d.dn, timestamps, rules); found {
+			recheck.fullDN = d.fullDN
+			recheck.group = d.group
+			confirmed = append(confirmed, recheck)
+		} else {
+			summary.resolved++
+		}
+	}
+	return confirmed, nil
+}
 
-		case ldap1Entry.dn_trunc < ldap2Entry.dn_trunc:
-			fmt.Printf("Missing entry on second server: %s\n", ldap1Entry.dn_trunc)
-			ldap1Entry = <-ldap1Entries
+// compareOptions control how differences are classified and confirmed.
+type compareOptions struct {
+	rules        inFlightRules
+	recheckDelay time.Duration // when non-zero flagged entries are looked up again after this delay
 
-		case ldap1Entry.dn_trunc > ldap2Entry.dn_trunc:
-			fmt.Printf("Missing entry on first server: %s\n", ldap2Entry.dn_trunc)
-			ldap2Entry = <-ldap2Entries
+	stateFile          string        // checkpoint file, "" for none
+	checkpointInterval time.Duration // how often the checkpoint is saved
+	resume             bool          // carry on from the checkpoint in stateFile
+	progressInterval   time.Duration // how often progress is reported, 0 for never
+
+	hashRanges bool // only stream the DN ranges whose hashes differ
+	hashFanout int  // number of sub-ranges a differing range is split into
+	hashLeaf   int  // ranges with no more entries than this are streamed
+
+	profile []profileAttribute // when set these attributes are compared rather than the timestamps
+	members bool               // compare the members of entries whose timestamps differ
+
+	parallel       int  // number of partitions compared concurrently, 1 or less for a single scan
+	partitionByRDN bool // partition on the first character of the DN rather than sampled boundaries
+}
+
+// comparison holds the state of a run across all the servers being compared.
+type comparison struct {
+	servers      []entrySource
+	options      compareOptions
+	sink         differenceSink
+	summary      *diffSummary
+	flagged      []difference // held back for the recheck pass
+	lastDN       string       // the last DN compared
+	groups       []difference // groups with differing timestamps, for their members to be compared
+	progress     *progressReporter
+	checkpointed time.Time
+}
+
+// compareEntry classifies the timestamps seen for one DN and reports it, or holds it back for the recheck.
+func (c *comparison) compareEntry(dn string, entries []ldapEntry) {
+	c.summary.compared++
+	c.lastDN = dn
+	timestamps := make([]string, len(entries))
+	for i, entry := range entries {
+		timestamps[i] = entry.modify_timestamp
+	}
+	if len(c.options.profile) > 0 {
+		c.compareProfile(dn, entries, timestamps)
+	} else if d, found := classifyEntry(dn, timestamps, c.options.rules); found {
+		d.fullDN = entryDN(entries)
+		for _, entry := range entries {
+			d.group = d.group || entry.group
+		}
+		// A missing timestamp won't have appeared by the recheck
+		if c.options.recheckDelay > 0 && d.kind != notComparable {
+			c.flagged = append(c.flagged, d)
+		} else {
+			c.report(d)
+		}
+	}
+	if c.progress != nil {
+		c.progress.update()
+	}
+	if c.options.stateFile != "" && time.Since(c.checkpointed) >= c.options.checkpointInterval {
+		if err := saveCheckpoint(c.options.stateFile, dn, c.summary, c.flagged, c.groups); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save checkpoint: ", err.Error())
+		}
+		c.checkpointed = time.Now()
+	}
+}
 
+// entryDN returns the full DN of the entries read for one dn_trunc key, as the first server holding it has it.
+func entryDN(entries []ldapEntry) string {
+	for _, entry := range entries {
+		if entry.dn != "" {
+			return entry.dn
 		}
 	}
-	for ldap1Entry.dn_trunc != "" {
-		fmt.Printf("Missing entry on second server: %s\n", ldap1Entry.dn_trunc)
-		ldap1Entry = <-ldap1Entries
+	return ""
+}
+
+// report counts a difference and passes it on to the sink.  Groups whose timestamps differ are remembered for
+// their members to be compared at the end.
+func (c *comparison) report(d difference) {
+	c.summary.add(d)
+	c.sink.writeDifference(d)
+	if c.options.members && d.kind == timestampMismatch && d.group {
+		c.groups = append(c.groups, d)
 	}
+}
 
-	for ldap2Entry.dn_trunc != "" {
-		fmt.Printf("Missing entry on first server: %s\n", ldap2Entry.dn_trunc)
-		ldap2Entry = <-ldap2Entries
+// mergeEntries reads streams of entries in dn_trunc order, one per label, calling visit once for each dn_trunc,
+// or for each full DN sharing a truncated one, with the entry from every stream that has it and a zero entry from
+// the rest.  The readers are started with list and stopped when the merge returns, however it ends.
+func mergeEntries(ctx context.Context, labels []string, list func(ctx context.Context, i int, out chan<- ldapEntry),
+	visit func(dn string, matched []ldapEntry)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	entries := make([]chan ldapEntry, len(labels))
+	current := make([]ldapEntry, len(labels))
+	for i := range labels {
+		entries[i] = make(chan ldapEntry, entryBuffer)
+		go list(ctx, i, entries[i])
+	}
+	// next moves a stream on to its next entry.  A source that failed aborts the comparison rather than have
+	// the rest of its entries reported as missing.
+	next := func(i int) error {
+		select {
+		case current[i] = <-entries[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if current[i].err != nil {
+			return fmt.Errorf("Reading %s failed: %v", labels[i], current[i].err)
+		}
+		return nil
+	}
+	for i := range entries {
+		if err := next(i); err != nil {
+			return err
+		}
 	}
 
+	for {
+		dn := ""
+		for _, entry := range current {
+			if entry.dn_trunc != "" && (dn == "" || entry.dn_trunc < dn) {
+				dn = entry.dn_trunc
+			}
+		}
+		if dn == "" {
+			break
+		}
+		if truncatedDN(dn) {
+			// Entries sharing a truncated key come in no particular order, so all of them are read and matched on
+			// their full DNs
+			runs := make([][]ldapEntry, len(labels))
+			for i := range current {
+				for current[i].dn_trunc == dn {
+					runs[i] = append(runs[i], current[i])
+					if err := next(i); err != nil {
+						return err
+					}
+				}
+			}
+			for _, matched := range matchFullDNs(runs) {
+				visit(dn, matched)
+			}
+			continue
+		}
+		matched := make([]ldapEntry, len(labels))
+		for i, entry := range current {
+			if verbose > 1 {
+				fmt.Printf("ldap%dEntry: %s\n", i+1, entry.dn_trunc)
+			}
+			if entry.dn_trunc == dn {
+				matched[i] = entry
+				if err := next(i); err != nil {
+					return err
+				}
+			}
+		}
+		visit(dn, matched)
+	}
 	return nil
 }
 
-func CreateConn(con string) *sql.DB {
+// truncatedDN reports whether a dn_trunc key may have been truncated, and so may be shared by several entries.
+// Truncating on a character boundary drops up to 3 bytes more.
+func truncatedDN(dn_trunc string) bool {
+	return len(dn_trunc) > dnTruncLength-utf8.UTFMax
+}
+
+// matchFullDNs matches up the entries read from each stream for one truncated key on their normalised full DNs,
+// returning the entries of each DN in DN order with a zero entry for the streams without it.  A DN held twice by a
+// stream is matched again as though it were another entry.
+func matchFullDNs(runs [][]ldapEntry) [][]ldapEntry {
+	var keys []string
+	var matches [][]ldapEntry
+	for i, run := range runs {
+		for _, entry := range run {
+			key := canonicalDN(entry.dn)
+			found := false
+			for j := range matches {
+				if keys[j] == key && matches[j][i].dn_trunc == "" {
+					matches[j][i] = entry
+					found = true
+					break
+				}
+			}
+			if !found {
+				matched := make([]ldapEntry, len(runs))
+				matched[i] = entry
+				keys = append(keys, key)
+				matches = append(matches, matched)
+			}
+		}
+	}
+	order := make([]int, len(matches))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+	sorted := make([][]ldapEntry, len(matches))
+	for i, j := range order {
+		sorted[i] = matches[j]
+	}
+	return sorted
+}
+
+// mergeRange streams the entries in the range from every server in dn_trunc order, merging them so each DN is
+// compared once.
+func (c *comparison) mergeRange(ctx context.Context, r keyRange) error {
+	labels := make([]string, len(c.servers))
+	for i, server := range c.servers {
+		labels[i] = server.label()
+	}
+	return mergeEntries(ctx, labels, func(ctx context.Context, i int, out chan<- ldapEntry) {
+		c.servers[i].listEntries(ctx, r, out)
+	}, c.compareEntry)
+}
+
+// finish rechecks any flagged entries and then compares the members of the groups whose timestamps differ.  Each
+// is dropped once done, and the counts of one interrupted part way are put back, so a checkpoint saved on an
+// interruption leaves a resumed comparison to do the rest.
+func (c *comparison) finish(ctx context.Context) error {
+	if len(c.flagged) > 0 {
+		resolved := c.summary.resolved
+		confirmed, err := recheckDifferences(ctx, c.servers, c.flagged, c.options, c.summary)
+		if err != nil {
+			c.summary.resolved = resolved
+			return err
+		}
+		c.flagged = nil
+		for _, d := range confirmed {
+			c.report(d)
+		}
+	}
+	for len(c.groups) > 0 {
+		members := c.summary.members
+		if err := c.compareMembers(ctx, c.groups[0]); err != nil {
+			c.summary.members = members
+			return err
+		}
+		c.groups = c.groups[1:]
+	}
+
+	if c.options.stateFile != "" {
+		// The comparison finished so there is nothing left to resume.
+		os.Remove(c.options.stateFile)
+	}
+	return nil
+}
+
+// interrupted marks the summary as covering only the entries compared before the comparison was cancelled.  With
+// a state file a checkpoint is saved so the comparison can be resumed, otherwise the flagged entries are reported
+// unconfirmed.
+func (c *comparison) interrupted(cause error) error {
+	if c.options.stateFile != "" && c.lastDN != "" {
+		if err := saveCheckpoint(c.options.stateFile, c.lastDN, c.summary, c.flagged, c.groups); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save checkpoint: ", err.Error())
+		}
+	} else {
+		for _, d := range c.flagged {
+			c.report(d)
+		}
+	}
+	c.summary.interrupted = true
+	return cause
+}
+
+// compareSources merges the entries of every source and passes every entry that is missing on some sources or has
+// diverging modify_timestamps to the sink, counting them in the summary.  With a recheck delay the flagged entries
+// are held back and only passed on once confirmed.  Cancelling ctx stops the comparison, marking the summary as
+// interrupted.
+func compareSources(ctx context.Context, servers []entrySource, options compareOptions, sink differenceSink, summary *diffSummary) error {
+	c := &comparison{servers: servers, options: options, sink: sink, summary: summary, checkpointed: time.Now()}
+
+	var r keyRange
+	if options.resume {
+		var err error
+		r.after, c.flagged, c.groups, err = loadCheckpoint(options.stateFile, summary)
+		if err != nil {
+			return err
+		}
+		if verbose > 0 {
+			fmt.Fprintf(os.Stderr, "Resuming after %s\n", r.after)
+		}
+	}
+
+	if options.progressInterval > 0 {
+		total := 0
+		for _, server := range servers {
+			database, ok := server.(*db2Source)
+			if !ok {
+				continue
+			}
+			countCtx, cancel := queryContext(ctx, database.queryTimeout)
+			count, err := countEntries(countCtx, database.conn, database.schema, r)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("Error on Query: %v", err)
+			}
+			if count > total {
+				total = count
+			}
+		}
+		c.progress = newProgressReporter(options.progressInterval, total)
+	}
+
+	var err error
+	switch {
+	case options.hashRanges:
+		err = c.compareHashRanges(ctx)
+	case options.parallel > 1:
+		err = c.compareParallel(ctx)
+	default:
+		err = c.mergeRange(ctx, r)
+	}
+	if err == nil {
+		err = c.finish(ctx)
+	}
+	if err != nil && ctx.Err() != nil {
+		return c.interrupted(ctx.Err())
+	}
+	return err
+}
+
+// compareAllEntryModifyTimestamps compares the entries of every server and writes the report, including a summary
+// of what was compared when the comparison is interrupted or aborted, so the report is always a complete document.
+func compareAllEntryModifyTimestamps(ctx context.Context, servers []entrySource, options compareOptions, writer DiffWriter, summary *diffSummary) error {
+	writer.writeHeader(summary)
+	err := compareSources(ctx, servers, options, writer, summary)
+	if err != nil && !summary.interrupted {
+		summary.aborted = err.Error()
+	}
+	summary.elapsed = time.Since(summary.started)
+	writer.writeSummary(summary)
+	return err
+}
+
+func CreateConn(con string, timeout time.Duration) *sql.DB {
 	db, err := sql.Open("go_ibm_db", con)
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
+	// Open only validates the arguments, so connect now to catch bad credentials before comparing anything.
+	ctx, cancel := queryContext(context.Background(), timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		fmt.Println(err)
+		db.Close()
+		return nil
+	}
 	return db
 }
 
@@ -113,6 +695,21 @@ usage: ldap_sdiff.go [-h] --dbname1 DBNAME [--hostname1 HOSTNAME]
                        [--port1 PORT] [--schema1 SCHEMA] [--userid1 USERID] --password1 PASSWORD
                        --dbname2 DBNAME [--hostname2 HOSTNAME]
                        [--port2 PORT] [--schema2 SCHEMA] [--userid2 USERID] --password2 PASSWORD
+                       [--dbnameN DBNAME [--hostnameN HOSTNAME]
+                       [--portN PORT] [--schemaN SCHEMA] [--useridN USERID] --passwordN PASSWORD ...]
+                       [--ldap_urlN LDAP_URL --basednN BASEDN [--binddnN BINDDN --bindpwN BINDPW] ...]
+                       [--tls_insecure] [--ldifN LDIF_FILE ...]
+                       [--tolerance DURATION] [--cutoff {DURATION,TIMESTAMP}] [--recheck DURATION]
+                       [--state_file STATE_FILE [--checkpoint DURATION] [--resume]]
+                       [--progress DURATION] [--query_timeout DURATION]
+                       [--hash [--hash_fanout FANOUT] [--hash_leaf ENTRIES]]
+                       [--parallel N [--partition {sample,rdn}]]
+                       [--profile {acl,pwdpolicy,groups}] [--members]
+                       [--format {text,csv,json,ndjson,junit}] [--output_file OUTPUT_FILE]
+                       [--history HISTORY_DB]
+       ldap_sdiff.go schema ...
+       ldap_sdiff.go config ...
+       ldap_sdiff.go history ...
 `))
 	if message != "" {
 		fmt.Println(message)
@@ -126,22 +723,142 @@ usage: ldap_sdiff.go [-h] --dbname1 DBNAME [--hostname1 HOSTNAME]
                        [--port1 PORT] [--schema1 SCHEMA] [--userid1 USERID] --password1 PASSWORD
                        --dbname2 DBNAME [--hostname2 HOSTNAME]
                        [--port2 PORT] [--schema2 SCHEMA] [--userid2 USERID] --password2 PASSWORD
-Provide DB2 connection details to determine replication status.
+                       [--dbnameN DBNAME [--hostnameN HOSTNAME]
+                       [--portN PORT] [--schemaN SCHEMA] [--useridN USERID] --passwordN PASSWORD ...]
+                       [--ldap_urlN LDAP_URL --basednN BASEDN [--binddnN BINDDN --bindpwN BINDPW] ...]
+                       [--tls_insecure] [--ldifN LDIF_FILE ...]
+                       [--tolerance DURATION] [--cutoff {DURATION,TIMESTAMP}] [--recheck DURATION]
+                       [--state_file STATE_FILE [--checkpoint DURATION] [--resume]]
+                       [--progress DURATION] [--query_timeout DURATION]
+                       [--hash [--hash_fanout FANOUT] [--hash_leaf ENTRIES]]
+                       [--parallel N [--partition {sample,rdn}]]
+                       [--profile {acl,pwdpolicy,groups}] [--members]
+                       [--format {text,csv,json,ndjson,junit}] [--output_file OUTPUT_FILE]
+                       [--history HISTORY_DB]
+       ldap_sdiff.go schema {--ldap_urlN LDAP_URL [--binddnN BINDDN --bindpwN BINDPW],--ldifN LDIF_FILE} ...
+                       [--tls_insecure] [--format FORMAT] [--output_file OUTPUT_FILE]
+       ldap_sdiff.go config --configN IBMSLAPD_CONF ... [--ignore ATTRIBUTES]
+                       [--format FORMAT] [--output_file OUTPUT_FILE]
+       ldap_sdiff.go history --history HISTORY_DB [--run RUN] [--against RUN] [--runs N]
+Provide DB2 or LDAP connection details to determine replication status.
+
+Any number of servers up to 8 can be compared in one pass by numbering their
+arguments 1, 2, 3, ...  Each entry is reported once with the timestamp seen on
+every server and the expected value (held by most servers, or the newest).
+
+A server can be compared over LDAP or LDAPS instead of through its DB2 database
+by giving --ldap_urlN in place of --dbnameN, so SDS can be compared against
+OpenLDAP, Active Directory or any other directory server.  DNs are normalised
+the way SDS stores them in dn_trunc and the entries are sorted on the client,
+so the DB2 databases compared against must use a binary (IDENTITY) collation.
+
+An LDIF export, such as one taken with db2ldif, can be used as a server with
+--ldifN to see what has changed since the export was taken.  Its entries need
+to include modifyTimestamp: entries read over LDAP or from LDIF without one are
+reported as not comparable rather than as differences.
+
+With --profile only particular classes of data are compared: acl (aclEntry,
+entryOwner and their propagation), pwdpolicy (pwdAccountLockedTime, pwdFailureTime
+and the rest of the password policy state) and groups (member, uniqueMember and
+memberURL).  The servers need to be read over LDAP, bound as a DN allowed to see
+these attributes, or from LDIF exports.  Differences in security-relevant
+attributes are reported in a section of their own, as a replica with stale ACLs
+is an incident rather than noise.
+
+Divergence can also come from the schema or server configuration.  The schema
+mode compares the attribute types, object classes, matching rules, syntaxes and
+indexes (ibmAttributeTypes) published in cn=schema, read over LDAP or from an
+LDIF file such as V3.modifiedschema.  Definitions are matched by OID and compared
+ignoring the order of their clauses, spacing and case.  The config mode compares
+ibmslapd.conf files entry by entry and attribute by attribute, ignoring the order
+of entries and values and differences in whitespace.  The encrypted passwords,
+which differ on every instance, are left out unless --ignore is given.
+
+Each comparison can be recorded in a SQLite database with --history, keeping the
+DN and kind of every difference.  The history mode lists the recorded runs of the
+same servers and sets the latest against the one before it: the differences that
+are new, those that persisted, with the number of runs in a row they have been
+seen in, and those that have been resolved.  Interrupted runs are listed but not
+compared, and changes in flight are left out.
 
 optional arguments:
   -h, --help           show this help message and exit
-  --dbname1 DBNAME      DB2 Database Name underlying LDAP.
-  --hostname1 HOSTNAME  Hostname of LDAP server (defaults to localhost).
-  --port1 PORT          Port# DB2 is listening on (defaults to 50000).
-  --schema1 SCHEMA      DB2 Table name schema (defaults to userid).
-  --userid1 USERID      Userid to connect to DB2 (defaults to dbname).
-  --password1 PASSWORD  Password to connect to DB2.
-  --dbname2 DBNAME      DB2 Database Name underlying LDAP.
-  --hostname2 HOSTNAME  Hostname of LDAP server (defaults to localhost).
-  --port2 PORT          Port# DB2 is listening on (defaults to 50000).
-  --schema2 SCHEMA      DB2 Table name schema (defaults to userid).
-  --userid2 USERID      Userid to connect to DB2 (defaults to dbname).
-  --password2 PASSWORD  Password to connect to DB2.
+  --dbnameN DBNAME      DB2 Database Name underlying LDAP.
+  --hostnameN HOSTNAME  Hostname of LDAP server (defaults to localhost).
+  --portN PORT          Port# DB2 is listening on (defaults to 50000).
+  --schemaN SCHEMA      DB2 Table name schema (defaults to userid).
+  --useridN USERID      Userid to connect to DB2 (defaults to dbname).
+  --passwordN PASSWORD  Password to connect to DB2.
+  --ldap_urlN LDAP_URL  Compare this server over LDAP, e.g. ldaps://host:636.
+  --basednN BASEDN      Subtree of the directory to compare.
+  --binddnN BINDDN      DN to bind as (defaults to an anonymous bind).
+  --bindpwN BINDPW      Password of the bind DN.
+  --tls_insecure        Don't verify the certificates of LDAPS servers.
+  --query_timeout DURATION
+                        Time allowed for connecting and for each query or LDAP
+                        request, up to the first row of a scan (defaults to no limit).
+  --ldifN LDIF_FILE     Compare against the entries in this LDIF file.
+  --tolerance DURATION  Timestamps differing by no more than this (e.g. 5s) are
+                        reported as in flight rather than mismatched (defaults to 0).
+  --cutoff {DURATION,TIMESTAMP}
+                        Entries modified after this time, or this long before the
+                        start of the run, are reported as in flight (defaults to
+                        the start of the run).
+  --recheck DURATION    Wait this long after the comparison and look the flagged
+                        entries up again, only reporting those still differing.
+  --state_file STATE_FILE
+                        Periodically save the last DN compared and the totals so far
+                        to this file.
+  --checkpoint DURATION How often the state file is saved (defaults to 1m).
+  --resume              Carry on from the DN saved in the state file.  The report
+                        then covers the remaining entries, with the summary totals
+                        including those already compared.
+  --progress DURATION   Report rows/sec, percentage complete and ETA on stderr at
+                        this interval.
+  --hash                Compare a count and hash of each DN range on the database
+                        servers first and only stream the ranges that differ.
+                        Needs DB2 11.1 or later for HASH4, and only DB2 sources.
+  --hash_fanout FANOUT  Number of sub-ranges a differing range is split into
+                        (defaults to 16).
+  --hash_leaf ENTRIES   Ranges with no more entries than this are streamed rather
+                        than split further (defaults to 10000).
+  --parallel N          Divide the DNs into ranges and scan N of them concurrently
+                        on each server, for DB2 hosts with several cores.  Only
+                        DB2 sources can be scanned by range.
+  --partition {sample,rdn}
+                        Take the range boundaries from a sample of the first
+                        database so the ranges are even, or from the first
+                        character of the DN (defaults to sample).
+  --profile {acl,pwdpolicy,groups}
+                        Compare the attributes of these comma separated profiles
+                        instead of the timestamps.  Needs LDAP or LDIF sources.
+  --members             Once the comparison is done, stream the member and
+                        uniqueMember values of each group (groupOfNames,
+                        groupOfUniqueNames or ibm-dynamicGroup) whose timestamps
+                        differ from every server and report the members missing
+                        on some.
+  --format {text,csv,json,ndjson,junit}
+                        Report format (defaults to text).
+  --output_file OUTPUT_FILE
+                        Output file for the report (defaults to stdout).
+  --history HISTORY_DB  Record the run and its differences in this SQLite database,
+                        or in history mode read them from it.
+  --configN IBMSLAPD_CONF
+                        ibmslapd.conf file to compare in config mode.
+  --ignore ATTRIBUTES   Comma separated attributes not compared in config mode
+                        (defaults to ibm-slapdAdminPW,ibm-slapdDbUserPW).
+  --run RUN             Run reported on in history mode (defaults to the latest
+                        complete run).
+  --against RUN         Run compared with in history mode (defaults to the complete
+                        run before it).
+  --runs N              Number of runs listed in history mode (defaults to 10).
+
+Exits with 0 when the databases are consistent (changes in flight are not counted),
+2 when differences were found, 3 when security-relevant attributes differ and 1 on
+any other error.  A server that fails part way through aborts the comparison,
+leaving any state file at the last checkpoint.  SIGINT or SIGTERM stop the
+comparison, writing the summary of the entries compared so far and saving a
+checkpoint to the state file if there is one.
 `))
 	os.Exit(1)
 }
@@ -149,20 +866,78 @@ optional arguments:
 // Set to different things by who is building
 var Version = "sandbox"
 
+// maxServers is the number of numbered sets of connection arguments accepted.
+const maxServers = 8
+
+// serverArgs holds the numbered command line arguments for one server.
+type serverArgs struct {
+	dbname   *string
+	hostname *string
+	port     *int
+	schema   *string
+	userid   *string
+	password *string
+	ldapURL  *string
+	baseDN   *string
+	bindDN   *string
+	bindPW   *string
+	ldif     *string
+}
+
+// defined reports whether any connection details were given for the server.
+func (a serverArgs) defined() bool {
+	return *a.dbname != "" || *a.ldapURL != "" || *a.ldif != ""
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "schema":
+			schemaMain(os.Args[2:])
+		case "config":
+			configMain(os.Args[2:])
+		case "history":
+			historyMain(os.Args[2:])
+		}
+	}
+
 	fs := flag.NewFlagSet("ldap_sdiff", flag.ContinueOnError)
-	dbname1Arg := fs.String("dbname1", "", "DB2 Database Name underlying LDAP.")
-	hostname1Arg := fs.String("hostname1", "localhost", "Hostname of LDAP server (defaults to localhost).")
-	port1Arg := fs.Int("port1", 50000, "Port# DB2 is listening on (defaults to 50000).")
-	schema1Arg := fs.String("schema1", "", "DB2 Table name schema (defaults to userid).")
-	userid1Arg := fs.String("userid1", "", "Userid to connect to DB2 (defaults to dbname).")
-	password1Arg := fs.String("password1", "", "Password to connect to DB2..")
-	dbname2Arg := fs.String("dbname2", "", "DB2 Database Name underlying LDAP.")
-	hostname2Arg := fs.String("hostname2", "localhost", "Hostname of LDAP server (defaults to localhost).")
-	port2Arg := fs.Int("port2", 50000, "Port# DB2 is listening on (defaults to 50000).")
-	schema2Arg := fs.String("schema2", "", "DB2 Table name schema (defaults to userid).")
-	userid2Arg := fs.String("userid2", "", "Userid to connect to DB2 (defaults to dbname).")
-	password2Arg := fs.String("password2", "", "Password to connect to DB2..")
+	args := make([]serverArgs, maxServers)
+	for i := range args {
+		n := i + 1
+		args[i] = serverArgs{
+			dbname:   fs.String(fmt.Sprintf("dbname%d", n), "", "DB2 Database Name underlying LDAP."),
+			hostname: fs.String(fmt.Sprintf("hostname%d", n), "localhost", "Hostname of LDAP server (defaults to localhost)."),
+			port:     fs.Int(fmt.Sprintf("port%d", n), 50000, "Port# DB2 is listening on (defaults to 50000)."),
+			schema:   fs.String(fmt.Sprintf("schema%d", n), "", "DB2 Table name schema (defaults to userid)."),
+			userid:   fs.String(fmt.Sprintf("userid%d", n), "", "Userid to connect to DB2 (defaults to dbname)."),
+			password: fs.String(fmt.Sprintf("password%d", n), "", "Password to connect to DB2."),
+			ldapURL:  fs.String(fmt.Sprintf("ldap_url%d", n), "", "Compare this server over LDAP, e.g. ldaps://host:636."),
+			baseDN:   fs.String(fmt.Sprintf("basedn%d", n), "", "Subtree of the directory to compare."),
+			bindDN:   fs.String(fmt.Sprintf("binddn%d", n), "", "DN to bind as (defaults to an anonymous bind)."),
+			bindPW:   fs.String(fmt.Sprintf("bindpw%d", n), "", "Password of the bind DN."),
+			ldif:     fs.String(fmt.Sprintf("ldif%d", n), "", "Compare against the entries in this LDIF file."),
+		}
+	}
+	tlsInsecureArg := fs.Bool("tls_insecure", false, "Don't verify the certificates of LDAPS servers.")
+	queryTimeoutArg := fs.Duration("query_timeout", 0, "Time allowed for each query or LDAP request (defaults to no limit).")
+	toleranceArg := fs.Duration("tolerance", 0, "Timestamp differences treated as in flight (defaults to 0).")
+	cutoffArg := fs.String("cutoff", "", "Entries modified after this time or duration ago are in flight (defaults to start of run).")
+	recheckArg := fs.Duration("recheck", 0, "Delay before looking flagged entries up again (defaults to no recheck).")
+	stateFileArg := fs.String("state_file", "", "File to checkpoint the comparison to.")
+	checkpointArg := fs.Duration("checkpoint", time.Minute, "How often the state file is saved (defaults to 1m).")
+	resumeArg := fs.Bool("resume", false, "Carry on from the DN saved in the state file.")
+	progressArg := fs.Duration("progress", 0, "Interval to report progress on stderr (defaults to none).")
+	hashArg := fs.Bool("hash", false, "Only stream the DN ranges whose hashes differ.")
+	hashFanoutArg := fs.Int("hash_fanout", 16, "Number of sub-ranges a differing range is split into (defaults to 16).")
+	hashLeafArg := fs.Int("hash_leaf", 10000, "Ranges with no more entries than this are streamed (defaults to 10000).")
+	parallelArg := fs.Int("parallel", 1, "Number of DN ranges scanned concurrently on each server (defaults to 1).")
+	partitionArg := fs.String("partition", "sample", "How the DN ranges are chosen: sample or rdn (defaults to sample).")
+	membersArg := fs.Bool("members", false, "Report the members that differ in groups whose timestamps differ.")
+	profileArg := fs.String("profile", "", "Compare the attributes of these profiles instead of timestamps: acl, pwdpolicy, groups.")
+	formatArg := fs.String("format", "text", "Report format: text, csv, json, ndjson or junit (defaults to text).")
+	outputFileArg := fs.String("output_file", "", "Output file for the report (defaults to stdout).")
+	historyArg := fs.String("history", "", "SQLite database to record the run and its differences in.")
 	verboseArg := fs.Int("verbose", 0, "Level of debugging (defaults to 0 - none).")
 	help := fs.Bool("help", false, "Display the full help text")
 
@@ -174,62 +949,235 @@ func main() {
 		DoHelp()
 	}
 
-	if *dbname2Arg == "" || *password2Arg == "" || *dbname1Arg == "" || *password1Arg == "" {
-		requiredArguments := ""
-		if *dbname1Arg == "" {
-			requiredArguments += " --dbname1"
+	// The servers are numbered from 1 and the first unused number ends the list.
+	count := 0
+	for count < maxServers && args[count].defined() {
+		count++
+	}
+	if count < 2 {
+		count = 2
+	}
+	requiredArguments := ""
+	otherServers := false // any servers not compared through DB2
+	for i := 0; i < count; i++ {
+		if *args[i].ldif != "" {
+			otherServers = true
+			continue
 		}
-		if *password1Arg == "" {
-			requiredArguments += " --password1"
+		if *args[i].ldapURL != "" {
+			otherServers = true
+			if *args[i].baseDN == "" {
+				requiredArguments += fmt.Sprintf(" --basedn%d", i+1)
+			}
+			continue
 		}
-		if *dbname2Arg == "" {
-			requiredArguments += " --dbname2"
+		if *args[i].dbname == "" {
+			requiredArguments += fmt.Sprintf(" --dbname%d", i+1)
 		}
-		if *password2Arg == "" {
-			requiredArguments += " --password2"
+		if *args[i].password == "" {
+			requiredArguments += fmt.Sprintf(" --password%d", i+1)
 		}
+	}
+	if requiredArguments != "" {
 		message := fmt.Sprintf("%s: error: the following arguments are required: %s\n", os.Args[0], requiredArguments)
 		DoUsage(message)
 	}
+	for i := count; i < maxServers; i++ {
+		if args[i].defined() {
+			message := fmt.Sprintf("%s: error: server %d given without server %d\n", os.Args[0], i+1, count+1)
+			DoUsage(message)
+		}
+	}
 
 	verbose = *verboseArg
 
-	userid1 := *userid1Arg
-	if *userid1Arg == "" {
-		userid1 = *dbname1Arg
+	start := time.Now().UTC()
+	options := compareOptions{
+		rules:        inFlightRules{tolerance: *toleranceArg, cutoff: start},
+		recheckDelay: *recheckArg,
+
+		stateFile:          *stateFileArg,
+		checkpointInterval: *checkpointArg,
+		resume:             *resumeArg,
+		progressInterval:   *progressArg,
+
+		hashRanges: *hashArg,
+		hashFanout: *hashFanoutArg,
+		hashLeaf:   *hashLeafArg,
+	}
+	if *hashArg && (*stateFileArg != "" || *progressArg > 0) {
+		DoUsage(fmt.Sprintf("%s: error: --hash cannot be combined with --state_file or --progress\n", os.Args[0]))
 	}
-	schema1 := *schema1Arg
-	if schema1 == "" {
-		schema1 = *userid1Arg
+	if *hashArg && otherServers {
+		DoUsage(fmt.Sprintf("%s: error: --hash can only be used to compare DB2 databases\n", os.Args[0]))
+	}
+	if *parallelArg > 1 {
+		options.parallel = *parallelArg
+		switch *partitionArg {
+		case "sample":
+		case "rdn":
+			options.partitionByRDN = true
+		default:
+			DoUsage(fmt.Sprintf("%s: error: --partition must be sample or rdn\n", os.Args[0]))
+		}
+		if *hashArg || *stateFileArg != "" || *progressArg > 0 {
+			DoUsage(fmt.Sprintf("%s: error: --parallel cannot be combined with --hash, --state_file or --progress\n", os.Args[0]))
+		}
+		if otherServers {
+			DoUsage(fmt.Sprintf("%s: error: --parallel can only be used to compare DB2 databases\n", os.Args[0]))
+		}
+	}
+	if *hashFanoutArg < 2 {
+		DoUsage(fmt.Sprintf("%s: error: --hash_fanout must be at least 2\n", os.Args[0]))
+	}
+	if *profileArg != "" {
+		profile, err := parseProfiles(*profileArg)
+		if err != nil {
+			DoUsage(fmt.Sprintf("%s: error: %v\n", os.Args[0], err))
+		}
+		options.profile = profile
+		if *recheckArg > 0 {
+			DoUsage(fmt.Sprintf("%s: error: --profile cannot be combined with --recheck\n", os.Args[0]))
+		}
+		for i := 0; i < count; i++ {
+			if *args[i].ldapURL == "" && *args[i].ldif == "" {
+				DoUsage(fmt.Sprintf("%s: error: --profile needs LDAP or LDIF sources, server %d is a DB2 database\n", os.Args[0], i+1))
+			}
+		}
+	}
+	if *membersArg {
+		options.members = true
+		if *profileArg != "" {
+			DoUsage(fmt.Sprintf("%s: error: --members cannot be combined with --profile\n", os.Args[0]))
+		}
+		for i := 0; i < count; i++ {
+			if *args[i].ldif != "" {
+				DoUsage(fmt.Sprintf("%s: error: --members needs DB2 or LDAP sources, server %d is an LDIF file\n", os.Args[0], i+1))
+			}
+		}
+	}
+	if *resumeArg && *stateFileArg == "" {
+		DoUsage(fmt.Sprintf("%s: error: --resume requires --state_file\n", os.Args[0]))
+	}
+	if *resumeArg && *historyArg != "" {
+		DoUsage(fmt.Sprintf("%s: error: --history cannot be combined with --resume, the report only covers the remaining entries\n", os.Args[0]))
+	}
+	if *cutoffArg != "" {
+		if age, err := time.ParseDuration(*cutoffArg); err == nil {
+			options.rules.cutoff = start.Add(-age)
+		} else if cutoff, err := parseTimestamp(*cutoffArg); err == nil {
+			options.rules.cutoff = cutoff
+		} else {
+			DoUsage(fmt.Sprintf("%s: error: --cutoff must be a duration or a timestamp: %s\n", os.Args[0], *cutoffArg))
+		}
 	}
 
-	userid2 := *userid2Arg
-	if *userid2Arg == "" {
-		userid2 = *dbname2Arg
+	out := os.Stdout
+	if *outputFileArg != "" {
+		var err error
+		out, err = os.Create(*outputFileArg)
+		if err != nil {
+			fmt.Printf("Unable to create %s: %v\n", *outputFileArg, err)
+			os.Exit(exitError)
+		}
+		defer out.Close()
 	}
-	schema2 := *schema2Arg
-	if schema2 == "" {
-		schema2 = *userid2Arg
+	writer, err := newDiffWriter(*formatArg, out)
+	if err != nil {
+		DoUsage(fmt.Sprintf("%s: error: %v\n", os.Args[0], err))
+	}
+	if *historyArg != "" {
+		history, err := newHistoryWriter(*historyArg, writer)
+		if err != nil {
+			fmt.Printf("Unable to open %s: %v\n", *historyArg, err)
+			os.Exit(exitError)
+		}
+		defer history.close()
+		writer = history
 	}
 
-	firstConnectionString := fmt.Sprintf("HOSTNAME=%s;DATABASE=%s;PORT=%d;UID=%s;PWD=%s", *hostname1Arg, *dbname1Arg, *port1Arg, userid1, *password1Arg)
-	secondConnectionString := fmt.Sprintf("HOSTNAME=%s;DATABASE=%s;PORT=%d;UID=%s;PWD=%s", *hostname2Arg, *dbname2Arg, *port2Arg, userid2, *password2Arg)
+	servers := make([]entrySource, count)
+	labels := make([]string, count)
+	for i := range servers {
+		if *args[i].ldif != "" {
+			source := &ldifSource{filename: *args[i].ldif, profile: options.profile}
+			if _, err := os.Stat(source.filename); err != nil {
+				fmt.Printf("Unable to read %s: %v\n", source.filename, err)
+				os.Exit(exitError)
+			}
+			servers[i] = source
+			labels[i] = source.label()
+			continue
+		}
+		if *args[i].ldapURL != "" {
+			source := &ldapSource{
+				url:     *args[i].ldapURL,
+				baseDN:  *args[i].baseDN,
+				bindDN:  *args[i].bindDN,
+				bindPW:  *args[i].bindPW,
+				profile: options.profile,
+				members: options.members,
+			}
+			source.conn, err = connectLDAP(source.url, source.bindDN, source.bindPW, *tlsInsecureArg, *queryTimeoutArg)
+			if err != nil {
+				fmt.Printf("Unable to connect successfully to %s: %v\n", source.label(), err)
+				os.Exit(exitError)
+			}
+			defer source.conn.Close()
+			servers[i] = source
+			labels[i] = source.label()
+			continue
+		}
+		source := &db2Source{
+			hostname:     *args[i].hostname,
+			port:         *args[i].port,
+			dbname:       *args[i].dbname,
+			userid:       *args[i].userid,
+			password:     *args[i].password,
+			schema:       *args[i].schema,
+			queryTimeout: *queryTimeoutArg,
+			members:      options.members,
+		}
+		if source.userid == "" {
+			source.userid = source.dbname
+		}
+		if source.schema == "" {
+			source.schema = source.userid
+		}
+		source.conn = CreateConn(source.connectionString(), source.queryTimeout)
+		if source.conn == nil {
+			fmt.Printf("Unable to connect successfully to %s!", source.label())
+			os.Exit(exitError)
+		}
+		servers[i] = source
+		labels[i] = source.label()
+	}
 
-	type Db *sql.DB
-	var firstConn Db
-	firstConn = CreateConn(firstConnectionString)
-	if firstConn == nil {
-		fmt.Printf("Unable to connect successfully to %s!", firstConnectionString)
-		os.Exit(1)
+	// SIGINT or SIGTERM stop the comparison with a summary of the entries compared so far.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	summary := newDiffSummary(labels)
+	if len(options.profile) > 0 {
+		summary.profiles = strings.ToLower(strings.Join(strings.Fields(strings.Replace(*profileArg, ",", " ", -1)), ", "))
 	}
-	var secondConn Db
-	secondConn = CreateConn(secondConnectionString)
-	if secondConn == nil {
-		fmt.Printf("Unable to connect successfully to %s!", secondConnectionString)
-		os.Exit(1)
+	err = compareAllEntryModifyTimestamps(ctx, servers, options, writer, summary)
+	if summary.interrupted {
+		fmt.Fprintln(os.Stderr, "Comparison interrupted, the report is incomplete")
+		out.Close()
+		os.Exit(exitError)
 	}
-	err := compareAllEntryModifyTimestamps(firstConn, secondConn, schema1, schema2)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, "Comparison aborted:", err)
+		out.Close()
+		os.Exit(exitError)
+	}
+	if summary.security > 0 {
+		out.Close()
+		os.Exit(exitSecurityDiverged)
+	}
+	if summary.differences() > 0 {
+		out.Close()
+		os.Exit(exitDifferencesFound)
 	}
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// checkpointDifference is a flagged difference waiting for the recheck pass, or a group waiting for its members to be
+// compared, as saved in the state file.
+type checkpointDifference struct {
+	DN         string   `json:"dn"`
+	FullDN     string   `json:"fullDN,omitempty"`
+	Status     diffKind `json:"status"`
+	Timestamps []string `json:"modifyTimestamps"`
+	Expected   string   `json:"expected"`
+	Group      bool     `json:"group,omitempty"`
+}
+
+// checkpointState is written to the state file so an interrupted comparison can carry on from the last DN.
+type checkpointState struct {
+	Servers        []string               `json:"servers"`
+	LastDN         string                 `json:"lastDN"`
+	Saved          time.Time              `json:"saved"`
+	Compared       int                    `json:"entriesCompared"`
+	MissingEntries int                    `json:"missingEntries"`
+	Mismatches     int                    `json:"timestampMismatches"`
+	Changed        int                    `json:"differingValues"`
+	Security       int                    `json:"securityDifferences"`
+	InFlight       int                    `json:"inFlight"`
+	NotComparable  int                    `json:"notComparable,omitempty"`
+	Members        int                    `json:"memberDifferences,omitempty"`
+	Resolved       int                    `json:"resolved,omitempty"`
+	Missing        []int                  `json:"missing"`
+	Divergent      []int                  `json:"divergent"`
+	Flagged        []checkpointDifference `json:"flagged,omitempty"`
+	Groups         []checkpointDifference `json:"groups,omitempty"`
+}
+
+// checkpointDifferences converts differences to the form they are saved in.
+func checkpointDifferences(differences []difference) []checkpointDifference {
+	var saved []checkpointDifference
+	for _, d := range differences {
+		saved = append(saved, checkpointDifference{d.dn, d.fullDN, d.kind, d.timestamps, d.expected, d.group})
+	}
+	return saved
+}
+
+// restoreDifferences converts saved differences back.
+func restoreDifferences(saved []checkpointDifference) []difference {
+	var differences []difference
+	for _, d := range saved {
+		differences = append(differences, difference{dn: d.DN, fullDN: d.FullDN, kind: d.Status, timestamps: d.Timestamps, expected: d.Expected, group: d.Group})
+	}
+	return differences
+}
+
+// saveCheckpoint records the last DN compared together with the totals so far, the differences waiting for the
+// recheck and the groups waiting for their members to be compared.  The file is replaced atomically so a failure
+// while writing leaves the previous checkpoint intact.
+func saveCheckpoint(filename string, lastDN string, summary *diffSummary, flagged []difference, groups []difference) error {
+	state := checkpointState{
+		Servers:        summary.servers,
+		LastDN:         lastDN,
+		Saved:          time.Now().UTC(),
+		Compared:       summary.compared,
+		MissingEntries: summary.missingEntries,
+		Mismatches:     summary.mismatches,
+		Changed:        summary.changed,
+		Security:       summary.security,
+		InFlight:       summary.inFlight,
+		NotComparable:  summary.notComparable,
+		Members:        summary.members,
+		Resolved:       summary.resolved,
+		Missing:        summary.missing,
+		Divergent:      summary.divergent,
+		Flagged:        checkpointDifferences(flagged),
+		Groups:         checkpointDifferences(groups),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFilename := filename + ".tmp"
+	if err := os.WriteFile(tempFilename, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempFilename, filename)
+}
+
+// loadCheckpoint restores the totals from a state file written for the same servers and returns the DN to
+// carry on after along with any flagged differences still waiting for the recheck and groups still waiting for
+// their members to be compared.
+func loadCheckpoint(filename string, summary *diffSummary) (string, []difference, []difference, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", nil, nil, fmt.Errorf("unable to read checkpoint %s: %v", filename, err)
+	}
+	if !reflect.DeepEqual(state.Servers, summary.servers) {
+		return "", nil, nil, fmt.Errorf("checkpoint %s was written for servers %v", filename, state.Servers)
+	}
+	summary.compared = state.Compared
+	summary.missingEntries = state.MissingEntries
+	summary.mismatches = state.Mismatches
+	summary.changed = state.Changed
+	summary.security = state.Security
+	summary.inFlight = state.InFlight
+	summary.notComparable = state.NotComparable
+	summary.members = state.Members
+	summary.resolved = state.Resolved
+	copy(summary.missing, state.Missing)
+	copy(summary.divergent, state.Divergent)
+	return state.LastDN, restoreDifferences(state.Flagged), restoreDifferences(state.Groups), nil
+}
+
+// countEntries returns the number of entries in the range.
+func countEntries(ctx context.Context, DBconn *sql.DB, schema string, r keyRange) (int, error) {
+	var count int
+	where, args := r.where()
+	err := DBconn.QueryRowContext(ctx, fmt.Sprintf("select count(*) from %s.ldap_entry %s", schema, where), args...).Scan(&count)
+	return count, err
+}
+
+// progressReporter prints the rate and estimated time remaining of a long comparison to stderr.
+type progressReporter struct {
+	interval time.Duration
+	total    int // entries expected in this run, 0 if unknown
+	started  time.Time
+	reported time.Time
+	rows     int
+}
+
+func newProgressReporter(interval time.Duration, total int) *progressReporter {
+	now := time.Now()
+	return &progressReporter{interval: interval, total: total, started: now, reported: now}
+}
+
+// update counts an entry and reports progress once the interval has passed.
+func (p *progressReporter) update() {
+	p.rows++
+	if time.Since(p.reported) < p.interval {
+		return
+	}
+	p.reported = time.Now()
+	elapsed := time.Since(p.started)
+	rate := float64(p.rows) / elapsed.Seconds()
+	if p.total <= 0 || rate == 0 {
+		fmt.Fprintf(os.Stderr, "Compared %d entries, %.0f rows/sec\n", p.rows, rate)
+		return
+	}
+	percent := 100 * float64(p.rows) / float64(p.total)
+	remaining := p.total - p.rows
+	if remaining < 0 {
+		remaining = 0
+	}
+	eta := time.Duration(float64(remaining)/rate) * time.Second
+	fmt.Fprintf(os.Stderr, "Compared %d of %d entries (%.1f%%), %.0f rows/sec, ETA %v\n",
+		p.rows, p.total, percent, rate, eta.Round(time.Second))
+}
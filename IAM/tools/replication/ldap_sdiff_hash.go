@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// rangeHash summarises the entries in a DN range so two servers can be compared without streaming the rows.
+type rangeHash struct {
+	count int
+	hash  int64
+}
+
+// hashRange has DB2 count the entries in the range and add up a CRC32 of each dn_trunc and modify_timestamp.  The
+// sum does not depend on the order the rows are visited in, so matching totals mean matching ranges.
+func hashRange(ctx context.Context, DBconn *sql.DB, schema string, r keyRange) (rangeHash, error) {
+	where, args := r.where()
+	hashRangeSQL := fmt.Sprintf("select count(*), coalesce(sum(bigint(hash4(dn_trunc || char(modify_timestamp - current timezone), 1))), 0) "+
+		"from %s.ldap_entry %s", schema, where)
+	var h rangeHash
+	err := DBconn.QueryRowContext(ctx, hashRangeSQL, args...).Scan(&h.count, &h.hash)
+	return h, err
+}
+
+// sampleBoundaries returns up to fanout DNs spreading the count entries of the range into roughly equal parts.
+func sampleBoundaries(ctx context.Context, DBconn *sql.DB, schema string, r keyRange, count int, fanout int) ([]string, error) {
+	step := (count + fanout - 1) / fanout
+	// An empty range has nothing to split, and DB2 fails mod(rn, 0) with a division by zero
+	if step < 1 {
+		return nil, nil
+	}
+	where, args := r.where()
+	sampleBoundariesSQL := fmt.Sprintf("select dn_trunc from ("+
+		"select dn_trunc, row_number() over (order by dn_trunc) as rn from %s.ldap_entry %s"+
+		") as ranked where mod(rn, ?) = 0 order by dn_trunc", schema, where)
+	rows, err := DBconn.QueryContext(ctx, sampleBoundariesSQL, append(args, step)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var boundaries []string
+	for rows.Next() {
+		var dn_trunc string
+		if err := rows.Scan(&dn_trunc); err != nil {
+			return nil, err
+		}
+		boundaries = append(boundaries, dn_trunc)
+	}
+	return boundaries, rows.Err()
+}
+
+// splitRange divides a range at the given boundaries.
+func splitRange(r keyRange, boundaries []string) []keyRange {
+	var ranges []keyRange
+	after := r.after
+	for _, boundary := range boundaries {
+		if boundary == r.upTo {
+			break
+		}
+		ranges = append(ranges, keyRange{after: after, upTo: boundary})
+		after = boundary
+	}
+	return append(ranges, keyRange{after: after, upTo: r.upTo})
+}
+
+// compareHashRanges compares the servers Merkle-style: a range whose count and hash agree on every server is
+// taken as consistent, one that differs is split into smaller ranges until they are small enough to stream.
+func (c *comparison) compareHashRanges(ctx context.Context) error {
+	databases := make([]*db2Source, len(c.servers))
+	for i, server := range c.servers {
+		database, ok := server.(*db2Source)
+		if !ok {
+			return fmt.Errorf("%s is not a DB2 database, ranges can only be hashed by DB2", server.label())
+		}
+		databases[i] = database
+	}
+
+	ranges := []keyRange{{}}
+	for len(ranges) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r := ranges[len(ranges)-1]
+		ranges = ranges[:len(ranges)-1]
+
+		hashes := make([]rangeHash, len(c.servers))
+		consistent := true
+		largest := 0
+		for i, database := range databases {
+			hashCtx, cancel := queryContext(ctx, database.queryTimeout)
+			h, err := hashRange(hashCtx, database.conn, database.schema, r)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("Error on Query: %v", err)
+			}
+			hashes[i] = h
+			consistent = consistent && h == hashes[0]
+			if h.count > hashes[largest].count {
+				largest = i
+			}
+		}
+		if verbose > 0 {
+			fmt.Fprintf(os.Stderr, "Range (%s, %s]: %v\n", r.after, r.upTo, hashes)
+		}
+		if consistent {
+			c.summary.compared += hashes[0].count
+			continue
+		}
+		if hashes[largest].count <= c.options.hashLeaf {
+			if err := c.mergeRange(ctx, r); err != nil {
+				return err
+			}
+			continue
+		}
+		database := databases[largest]
+		sampleCtx, cancel := queryContext(ctx, database.queryTimeout)
+		boundaries, err := sampleBoundaries(sampleCtx, database.conn, database.schema, r, hashes[largest].count, c.options.hashFanout)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Error on Query: %v", err)
+		}
+		subRanges := splitRange(r, boundaries)
+		if len(subRanges) < 2 {
+			// The range can't be split any further.
+			if err := c.mergeRange(ctx, r); err != nil {
+				return err
+			}
+			continue
+		}
+		// Push in reverse so the ranges are visited, and reported, in DN order.
+		for i := len(subRanges) - 1; i >= 0; i-- {
+			ranges = append(ranges, subRanges[i])
+		}
+	}
+	return nil
+}
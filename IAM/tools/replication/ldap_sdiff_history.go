@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historySchema creates the tables of the history database.  Runs are keyed by the servers and profiles compared
+// so only runs comparing the same things are set against each other.
+const historySchema = `
+create table if not exists runs (
+	id          integer primary key autoincrement,
+	started     text not null,
+	servers     text not null,
+	profiles    text not null,
+	compared    integer not null default 0,
+	differences integer not null default 0,
+	interrupted integer not null default 0
+);
+create table if not exists differences (
+	run_id integer not null references runs (id),
+	dn     text not null,
+	kind   text not null
+);
+create index if not exists differences_run_dn on differences (run_id, dn);
+`
+
+// openHistory opens the SQLite history database, creating it if it doesn't exist.
+func openHistory(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// historyWriter records the run and its differences in the history database as they are passed on to the report.
+// Everything is written in one transaction, so a run that aborts leaves nothing behind.
+type historyWriter struct {
+	DiffWriter
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+	run    int64
+	err    error // the first failure to record the run, reported with the summary
+}
+
+func newHistoryWriter(filename string, writer DiffWriter) (*historyWriter, error) {
+	db, err := openHistory(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &historyWriter{DiffWriter: writer, db: db}, nil
+}
+
+func (w *historyWriter) writeHeader(summary *diffSummary) {
+	w.DiffWriter.writeHeader(summary)
+	w.err = func() error {
+		var err error
+		if w.tx, err = w.db.Begin(); err != nil {
+			return err
+		}
+		result, err := w.tx.Exec("insert into runs (started, servers, profiles) values (?, ?, ?)",
+			summary.started.UTC().Format(time.RFC3339), strings.Join(summary.servers, "\n"), summary.profiles)
+		if err != nil {
+			return err
+		}
+		if w.run, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		w.insert, err = w.tx.Prepare("insert into differences (run_id, dn, kind) values (?, ?, ?)")
+		return err
+	}()
+}
+
+func (w *historyWriter) writeDifference(d difference) {
+	w.DiffWriter.writeDifference(d)
+	if w.err == nil {
+		_, w.err = w.insert.Exec(w.run, d.dn, string(d.kind))
+	}
+}
+
+// writeSummary commits the run, or rolls it back when the comparison aborted as its differences are incomplete.
+func (w *historyWriter) writeSummary(summary *diffSummary) {
+	w.DiffWriter.writeSummary(summary)
+	if summary.aborted != "" {
+		if w.tx != nil {
+			w.tx.Rollback()
+		}
+		return
+	}
+	if w.err == nil {
+		_, w.err = w.tx.Exec("update runs set compared = ?, differences = ?, interrupted = ? where id = ?",
+			summary.compared, summary.differences(), summary.interrupted, w.run)
+	}
+	if w.err == nil {
+		w.err = w.tx.Commit()
+	} else if w.tx != nil {
+		w.tx.Rollback()
+	}
+	if w.err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to record the run in the history: %v\n", w.err)
+	}
+}
+
+func (w *historyWriter) close() {
+	w.db.Close()
+}
+
+// historyRun is a run read back from the history database.
+type historyRun struct {
+	id          int64
+	started     string
+	servers     string
+	profiles    string
+	compared    int
+	differences int
+	interrupted bool
+}
+
+// historyRuns returns up to limit of the latest runs comparing the same servers and profiles as run, newest first.
+// With no run given the latest complete run decides what is compared.
+func historyRuns(db *sql.DB, run int64, limit int) ([]historyRun, error) {
+	var servers, profiles string
+	var err error
+	if run > 0 {
+		err = db.QueryRow("select servers, profiles from runs where id = ?", run).Scan(&servers, &profiles)
+	} else {
+		err = db.QueryRow("select servers, profiles from runs where interrupted = 0 order by id desc limit 1").Scan(&servers, &profiles)
+	}
+	if err == sql.ErrNoRows {
+		if run > 0 {
+			return nil, fmt.Errorf("there is no run %d in the history", run)
+		}
+		return nil, fmt.Errorf("there are no complete runs in the history")
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select id, started, servers, profiles, compared, differences, interrupted from runs "+
+		"where servers = ? and profiles = ? order by id desc limit ?", servers, profiles, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []historyRun
+	for rows.Next() {
+		var r historyRun
+		if err := rows.Scan(&r.id, &r.started, &r.servers, &r.profiles, &r.compared, &r.differences, &r.interrupted); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// runDifferences returns the kind of each difference recorded for a run, keyed by DN.  Changes in flight are left
+// out as they are expected to have gone by the next run, and entries that couldn't be compared as they aren't
+// differences.
+func runDifferences(db *sql.DB, run int64) (map[string]string, error) {
+	rows, err := db.Query("select dn, kind from differences where run_id = ? and kind not in (?, ?)", run,
+		string(changeInFlight), string(notComparable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	differences := make(map[string]string)
+	for rows.Next() {
+		var dn, kind string
+		if err := rows.Scan(&dn, &kind); err != nil {
+			return nil, err
+		}
+		differences[dn] = kind
+	}
+	return differences, rows.Err()
+}
+
+// changedDifferences returns the DNs, in order, that differ in one run and not in the other.
+func changedDifferences(in map[string]string, notIn map[string]string) []string {
+	var dns []string
+	for dn := range in {
+		if _, found := notIn[dn]; !found {
+			dns = append(dns, dn)
+		}
+	}
+	sort.Strings(dns)
+	return dns
+}
+
+// historyMain reports how the differences found by the recorded runs have changed: the totals of each run and which
+// differences are new, which persisted and which were resolved since an earlier run.
+func historyMain(arguments []string) {
+	fs := flag.NewFlagSet("ldap_sdiff history", flag.ContinueOnError)
+	historyArg := fs.String("history", "", "SQLite database the runs were recorded in.")
+	runArg := fs.Int64("run", 0, "Run to report on (defaults to the latest complete run).")
+	againstArg := fs.Int64("against", 0, "Earlier run to compare with (defaults to the complete run before it).")
+	runsArg := fs.Int("runs", 10, "Number of runs listed (defaults to 10).")
+	help := fs.Bool("help", false, "Display the full help text")
+
+	if err := fs.Parse(arguments); err != nil {
+		os.Exit(exitError)
+	}
+	if *help {
+		DoHelp()
+	}
+	if *historyArg == "" {
+		DoHistoryUsage(fmt.Sprintf("%s: error: the following arguments are required: --history\n", os.Args[0]))
+	}
+	if _, err := os.Stat(*historyArg); err != nil {
+		fmt.Printf("Unable to read %s: %v\n", *historyArg, err)
+		os.Exit(exitError)
+	}
+	db, err := openHistory(*historyArg)
+	if err != nil {
+		fmt.Printf("Unable to open %s: %v\n", *historyArg, err)
+		os.Exit(exitError)
+	}
+	err = reportHistory(db, *runArg, *againstArg, *runsArg)
+	db.Close()
+	if err != nil {
+		fmt.Printf("Unable to read the history from %s: %v\n", *historyArg, err)
+		os.Exit(exitError)
+	}
+	os.Exit(exitConsistent)
+}
+
+// reportHistory writes the list of runs and the differences between run and against.
+func reportHistory(db *sql.DB, run int64, against int64, limit int) error {
+	runs, err := historyRuns(db, run, limit)
+	if err != nil {
+		return err
+	}
+	// The runs to compare default to the latest complete run and the complete run before it.
+	current := -1
+	for i, r := range runs {
+		if (run == 0 && !r.interrupted) || r.id == run {
+			current = i
+			break
+		}
+	}
+	if current < 0 {
+		return fmt.Errorf("run %d is older than the %d runs listed", run, limit)
+	}
+	if against == 0 {
+		for _, r := range runs[current+1:] {
+			if !r.interrupted {
+				against = r.id
+				break
+			}
+		}
+	}
+
+	fmt.Printf("Runs comparing %s", strings.Replace(runs[current].servers, "\n", ", ", -1))
+	if runs[current].profiles != "" {
+		fmt.Printf(" (profiles %s)", runs[current].profiles)
+	}
+	fmt.Println()
+	fmt.Printf("%6s  %-20s  %10s  %11s\n", "Run", "Started", "Compared", "Differences")
+	for _, r := range runs {
+		note := ""
+		if r.interrupted {
+			note = "  interrupted"
+		}
+		fmt.Printf("%6d  %-20s  %10d  %11d%s\n", r.id, r.started, r.compared, r.differences, note)
+	}
+
+	if against == 0 {
+		fmt.Println("\nThere is no earlier complete run to compare with")
+		return nil
+	}
+	latest, err := runDifferences(db, runs[current].id)
+	if err != nil {
+		return err
+	}
+	earlier, err := runDifferences(db, against)
+	if err != nil {
+		return err
+	}
+
+	added := changedDifferences(latest, earlier)
+	resolved := changedDifferences(earlier, latest)
+	var persisted []string
+	streaks := make(map[string]int)
+	for _, dn := range changedDifferences(latest, nil) {
+		if _, found := earlier[dn]; found {
+			persisted = append(persisted, dn)
+			streaks[dn] = 1
+		}
+	}
+
+	// Count the complete runs in a row, back from the current one, each persisting difference has been seen in,
+	// to pick out the entries that are stuck rather than catching up.
+	seen := make(map[string]bool)
+	for dn := range streaks {
+		seen[dn] = true
+	}
+	for _, r := range runs[current+1:] {
+		if r.interrupted || len(seen) == 0 {
+			continue
+		}
+		found, err := runDifferences(db, r.id)
+		if err != nil {
+			return err
+		}
+		for dn := range seen {
+			if _, ok := found[dn]; ok {
+				streaks[dn]++
+			} else {
+				delete(seen, dn)
+			}
+		}
+	}
+
+	fmt.Printf("\nRun %d against run %d: %d new, %d persisted, %d resolved\n", runs[current].id, against,
+		len(added), len(persisted), len(resolved))
+	if len(added) > 0 {
+		fmt.Println("\nNew differences:")
+		for _, dn := range added {
+			fmt.Printf("  %-9s  %s\n", latest[dn], dn)
+		}
+	}
+	if len(persisted) > 0 {
+		fmt.Println("\nPersisted differences:")
+		for _, dn := range persisted {
+			fmt.Printf("  %-9s  %s (%d runs)\n", latest[dn], dn, streaks[dn])
+		}
+	}
+	if len(resolved) > 0 {
+		fmt.Println("\nResolved differences:")
+		for _, dn := range resolved {
+			fmt.Printf("  %-9s  %s\n", earlier[dn], dn)
+		}
+	}
+	return nil
+}
+
+func DoHistoryUsage(message string) {
+	fmt.Println(strings.TrimSpace(`
+usage: ldap_sdiff.go history [-h] --history HISTORY_DB [--run RUN] [--against RUN] [--runs N]
+`))
+	if message != "" {
+		fmt.Println(message)
+	}
+	os.Exit(1)
+}
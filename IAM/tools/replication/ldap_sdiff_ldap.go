@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// dnTruncLength is the length SDS truncates normalised DNs to in ldap_entry.dn_trunc.
+const dnTruncLength = 240
+
+// ldapPageSize is the number of entries requested per page of a paged search.
+const ldapPageSize = 1000
+
+// ldapSortChunk is the number of entries sorted in memory before spilling a run to disk.
+const ldapSortChunk = 500000
+
+// normalizeDN puts a DN in the form SDS keeps in dn_trunc: the canonicalDN truncated to dnTruncLength without
+// splitting a character.
+func normalizeDN(dn string) string {
+	normalized := canonicalDN(dn)
+	if len(normalized) > dnTruncLength {
+		end := dnTruncLength
+		for end > 0 && !utf8.RuneStart(normalized[end]) {
+			end--
+		}
+		normalized = normalized[:end]
+	}
+	return normalized
+}
+
+// canonicalDN puts a DN in a form that is the same however it was written: attribute types and values upper-cased
+// with no spaces around the separators.  The values are escaped again once parsed, so "cn=Smith\, John" keeps its
+// comma as part of the value.  DNs that can't be parsed are just upper-cased.
+func canonicalDN(dn string) string {
+	normalized := strings.ToUpper(dn)
+	if parsed, err := ldap.ParseDN(dn); err == nil {
+		rdns := make([]string, len(parsed.RDNs))
+		for i, rdn := range parsed.RDNs {
+			attributes := make([]string, len(rdn.Attributes))
+			for j, attribute := range rdn.Attributes {
+				attributes[j] = strings.ToUpper(attribute.Type) + "=" + escapeDNValue(strings.ToUpper(attribute.Value))
+			}
+			rdns[i] = strings.Join(attributes, "+")
+		}
+		normalized = strings.Join(rdns, ",")
+	}
+	return normalized
+}
+
+// escapeDNValue escapes the characters of an attribute value that RFC 4514 doesn't allow unescaped in a DN.
+func escapeDNValue(value string) string {
+	var escaped strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`"+,;<>\`, r), r == '#' && i == 0, r == ' ' && (i == 0 || i == len(value)-1):
+			escaped.WriteByte('\\')
+			escaped.WriteRune(r)
+		case r == 0:
+			escaped.WriteString(`\00`)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
+
+// connectLDAP opens and binds a connection to the directory server, anonymously when no bind DN is given.  A
+// non-zero timeout limits connecting and each request made on the connection.
+func connectLDAP(url string, bindDN string, bindPW string, insecure bool, timeout time.Duration) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(url, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: insecure}),
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetTimeout(timeout)
+	}
+	if bindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(bindDN, bindPW)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ldapSource reads the entries from a directory server over LDAP or LDAPS.
+type ldapSource struct {
+	url     string
+	bindDN  string
+	bindPW  string
+	baseDN  string
+	conn    *ldap.Conn
+	profile []profileAttribute // attributes read along with the timestamps
+	members bool               // mark the entries that are groups
+}
+
+func (s *ldapSource) label() string {
+	return fmt.Sprintf("%s/%s", s.url, s.baseDN)
+}
+
+func (s *ldapSource) listEntries(ctx context.Context, r keyRange, out chan<- ldapEntry) {
+	listAllLDAPEntries(ctx, s.conn, s.baseDN, s.profile, s.members, r, out)
+}
+
+func (s *ldapSource) lookupEntry(ctx context.Context, key string, dn string) (string, bool, error) {
+	timestamp, err := lookupLDAPEntry(s.conn, dn)
+	return timestamp, true, err
+}
+
+// listAllLDAPEntries reads every entry under the base DN with a paged search and sends those in the range to out
+// in dn_trunc order.  Directory servers return entries in no particular order and few can sort on the DN, so the
+// entries are sorted client side, spilling to disk for large directories.  The attributes of the profile are read
+// along with the timestamps, and with members the object classes to mark the groups.  A failure is sent as a final
+// entry carrying the error.
+func listAllLDAPEntries(ctx context.Context, conn *ldap.Conn, baseDN string, profile []profileAttribute, members bool, r keyRange, out chan<- ldapEntry) {
+	defer close(out)
+	sorter := newExternalSorter(ldapSortChunk)
+	defer sorter.cleanup()
+
+	names := append([]string{"modifyTimestamp"}, profileAttributeNames(profile)...)
+	if members {
+		names = append(names, "objectClass")
+	}
+	paging := ldap.NewControlPaging(ldapPageSize)
+	request := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", names, []ldap.Control{paging})
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		result, err := conn.Search(request)
+		if err != nil {
+			sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Search: %v", err)})
+			return
+		}
+		for _, entry := range result.Entries {
+			timestamp := normalizeTimestamp(entry.GetEqualFoldAttributeValue("modifyTimestamp"))
+			if timestamp == "" {
+				timestamp = unknownTimestamp
+			}
+			attributes := profileValues(profile, entry.GetEqualFoldAttributeValues)
+			group := members && isGroup(entry.GetEqualFoldAttributeValues("objectClass"))
+			if err := sorter.add(ldapEntry{dn_trunc: normalizeDN(entry.DN), dn: entry.DN, modify_timestamp: timestamp, attributes: attributes, group: group}); err != nil {
+				sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Sort: %v", err)})
+				return
+			}
+		}
+		control := ldap.FindControl(result.Controls, ldap.ControlTypePaging)
+		if control == nil {
+			break
+		}
+		cookie := control.(*ldap.ControlPaging).Cookie
+		if len(cookie) == 0 {
+			break
+		}
+		paging.SetCookie(cookie)
+	}
+
+	if err := sorter.sorted(ctx, r, out); err != nil && ctx.Err() == nil {
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Sort: %v", err)})
+	}
+}
+
+// lookupLDAPEntry fetches the current modifyTimestamp of a single entry, returning "" when it does not exist.
+func lookupLDAPEntry(conn *ldap.Conn, dn string) (string, error) {
+	request := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"modifyTimestamp"}, nil)
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", nil
+	}
+	timestamp := normalizeTimestamp(result.Entries[0].GetEqualFoldAttributeValue("modifyTimestamp"))
+	if timestamp == "" {
+		timestamp = unknownTimestamp
+	}
+	return timestamp, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ldifRecord collects the lines of one LDIF record as it is read.
+type ldifRecord struct {
+	dn         string
+	attributes map[string][]string // keyed by lower-cased attribute name
+}
+
+// addLine decodes an unfolded "name: value" or base64 "name:: value" line into the record.  URL values
+// ("name:< url") are not fetched and are skipped.
+func (r *ldifRecord) addLine(line string) error {
+	separator := strings.Index(line, ":")
+	if separator < 0 {
+		return fmt.Errorf("invalid LDIF line %q", line)
+	}
+	name := strings.ToLower(strings.TrimSpace(line[:separator]))
+	value := line[separator+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return fmt.Errorf("invalid base64 value for %s: %v", name, err)
+		}
+		value = string(decoded)
+	case strings.HasPrefix(value, "<"):
+		return nil
+	default:
+		value = strings.TrimLeft(value, " ")
+	}
+	if name == "dn" {
+		r.dn = value
+		return nil
+	}
+	r.attributes[name] = append(r.attributes[name], value)
+	return nil
+}
+
+// readLDIF parses LDIF content, calling add for each record with its DN and attributes.  The version line and
+// comments are skipped and folded lines are joined.
+func readLDIF(reader io.Reader, add func(dn string, attributes map[string][]string) error) error {
+	input := bufio.NewReader(reader)
+	record := ldifRecord{attributes: make(map[string][]string)}
+	var line string
+	comment := false
+
+	flushLine := func() error {
+		defer func() { line = "" }()
+		if line == "" || comment {
+			return nil
+		}
+		if record.dn == "" && strings.HasPrefix(strings.ToLower(line), "version:") {
+			return nil
+		}
+		return record.addLine(line)
+	}
+	flushRecord := func() error {
+		if err := flushLine(); err != nil {
+			return err
+		}
+		if record.dn != "" {
+			if err := add(record.dn, record.attributes); err != nil {
+				return err
+			}
+		}
+		record = ldifRecord{attributes: make(map[string][]string)}
+		return nil
+	}
+
+	for {
+		text, err := input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		text = strings.TrimRight(text, "\r\n")
+		switch {
+		case strings.HasPrefix(text, " "):
+			// Continuation of a folded line
+			line += text[1:]
+		case text == "":
+			if ferr := flushRecord(); ferr != nil {
+				return ferr
+			}
+		default:
+			if ferr := flushLine(); ferr != nil {
+				return ferr
+			}
+			comment = strings.HasPrefix(text, "#")
+			line = text
+		}
+		if err == io.EOF {
+			return flushRecord()
+		}
+	}
+}
+
+// ldifSource reads the entries from an LDIF export.  An export doesn't change, so its entries are never looked up
+// again.
+type ldifSource struct {
+	filename string
+	profile  []profileAttribute // attributes read along with the timestamps
+}
+
+func (s *ldifSource) label() string {
+	return "ldif:" + s.filename
+}
+
+func (s *ldifSource) listEntries(ctx context.Context, r keyRange, out chan<- ldapEntry) {
+	listAllLDIFEntries(ctx, s.filename, s.profile, r, out)
+}
+
+func (s *ldifSource) lookupEntry(ctx context.Context, key string, dn string) (string, bool, error) {
+	return "", false, nil
+}
+
+// listAllLDIFEntries reads an LDIF export, such as one from db2ldif, and sends the entries in the range to out
+// in dn_trunc order, sorting them on disk when the file is too large to sort in memory.  The attributes of the
+// profile are read along with the timestamps.  A failure is sent as a final entry carrying the error.
+func listAllLDIFEntries(ctx context.Context, filename string, profile []profileAttribute, r keyRange, out chan<- ldapEntry) {
+	defer close(out)
+	sorter := newExternalSorter(ldapSortChunk)
+	defer sorter.cleanup()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Open: %v", err)})
+		return
+	}
+	defer f.Close()
+	err = readLDIF(f, func(dn string, attributes map[string][]string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		timestamp := unknownTimestamp
+		if values := attributes["modifytimestamp"]; len(values) > 0 {
+			timestamp = normalizeTimestamp(values[0])
+		}
+		values := profileValues(profile, func(name string) []string { return attributes[strings.ToLower(name)] })
+		return sorter.add(ldapEntry{dn_trunc: normalizeDN(dn), dn: dn, modify_timestamp: timestamp, attributes: values})
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Read: %v", err)})
+		}
+		return
+	}
+
+	if err := sorter.sorted(ctx, r, out); err != nil && ctx.Err() == nil {
+		sendEntry(ctx, out, ldapEntry{err: fmt.Errorf("Error on Sort: %v", err)})
+	}
+}
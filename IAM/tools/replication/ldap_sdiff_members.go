@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"strconv"
+	"strings"
+)
+
+// memberAttributes are the attributes holding the static members of a group.
+var memberAttributes = []string{"member", "uniqueMember"}
+
+// groupObjectClasses are the object classes of the groups whose members are compared.
+var groupObjectClasses = []string{"groupOfNames", "groupOfUniqueNames", "ibm-dynamicGroup"}
+
+// isGroup reports whether any of an entry's object classes is that of a group.
+func isGroup(objectClasses []string) bool {
+	for _, objectClass := range objectClasses {
+		for _, groupClass := range groupObjectClasses {
+			if strings.EqualFold(strings.TrimSpace(objectClass), groupClass) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memberSortChunk is the number of members sorted in memory before spilling a run to disk, kept small so groups
+// of hundreds of thousands of members don't have to be held in memory.
+const memberSortChunk = 50000
+
+// memberSource is implemented by the sources that can list the members of a single group.
+type memberSource interface {
+	// listMembers sends the normalised values of the group's member attribute to out in order and closes it.  The
+	// group is given by its dn_trunc key and its full DN, as for entrySource.lookupEntry.  A failure is sent as a
+	// final entry carrying the error.
+	listMembers(ctx context.Context, key string, group string, attribute string, out chan<- ldapEntry)
+}
+
+// sortedMembers sends the members added to the sorter to out, or the error that stopped them being read.
+func sortedMembers(ctx context.Context, sorter *externalSorter, err error, out chan<- ldapEntry) {
+	if err == nil {
+		err = sorter.sorted(ctx, keyRange{}, out)
+	}
+	if err != nil && ctx.Err() == nil {
+		sendEntry(ctx, out, ldapEntry{err: err})
+	}
+}
+
+// listMembers reads the group's members from the attribute's own table, which SDS keys by the entry's eid.  The
+// values are sorted on the client so they are in the same order as those read from other servers.
+func (s *db2Source) listMembers(ctx context.Context, key string, group string, attribute string, out chan<- ldapEntry) {
+	defer close(out)
+	sorter := newExternalSorter(memberSortChunk)
+	defer sorter.cleanup()
+	listMembersSQL := fmt.Sprintf("select a.%s from %s.%s a, %s.ldap_entry e where a.eid = e.eid and e.dn_trunc = ?",
+		attribute, s.schema, attribute, s.schema)
+
+	err := func() error {
+		queryCtx, cancel := queryContext(ctx, s.queryTimeout)
+		defer cancel()
+		rows, err := s.conn.QueryContext(queryCtx, listMembersSQL, key)
+		if err != nil {
+			return fmt.Errorf("Error on Query: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var member string
+			if err := rows.Scan(&member); err != nil {
+				return fmt.Errorf("Error on Scan: %v", err)
+			}
+			if err := sorter.add(ldapEntry{dn_trunc: normalizeDN(member), dn: member}); err != nil {
+				return fmt.Errorf("Error on Sort: %v", err)
+			}
+		}
+		return rows.Err()
+	}()
+	sortedMembers(ctx, sorter, err, out)
+}
+
+// listMembers reads the group's members over LDAP.  Servers that return large attributes in ranges, such as
+// "member;range=0-1499", are asked for each range in turn.
+func (s *ldapSource) listMembers(ctx context.Context, key string, group string, attribute string, out chan<- ldapEntry) {
+	defer close(out)
+	sorter := newExternalSorter(memberSortChunk)
+	defer sorter.cleanup()
+	name := strings.ToLower(attribute)
+
+	err := func() error {
+		requested := attribute
+		for ctx.Err() == nil {
+			request := ldap.NewSearchRequest(group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+				"(objectClass=*)", []string{requested}, nil)
+			result, err := s.conn.Search(request)
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Error on Search: %v", err)
+			}
+			if len(result.Entries) == 0 {
+				return nil
+			}
+			next := -1
+			for _, values := range result.Entries[0].Attributes {
+				returned := strings.ToLower(values.Name)
+				if returned != name && !strings.HasPrefix(returned, name+";range=") {
+					continue
+				}
+				for _, member := range values.Values {
+					if err := sorter.add(ldapEntry{dn_trunc: normalizeDN(member), dn: member}); err != nil {
+						return fmt.Errorf("Error on Sort: %v", err)
+					}
+				}
+				// A range ending in "*" holds the last of the values.
+				if bounds := strings.TrimPrefix(returned, name+";range="); bounds != returned && !strings.HasSuffix(bounds, "-*") {
+					high, err := strconv.Atoi(bounds[strings.Index(bounds, "-")+1:])
+					if err != nil {
+						return fmt.Errorf("invalid range %s", values.Name)
+					}
+					next = high + 1
+				}
+			}
+			if next < 0 {
+				return nil
+			}
+			requested = fmt.Sprintf("%s;range=%d-*", attribute, next)
+		}
+		return ctx.Err()
+	}()
+	sortedMembers(ctx, sorter, err, out)
+}
+
+// compareMembers streams the members of a group from every server and reports each member missing on some of
+// them.
+func (c *comparison) compareMembers(ctx context.Context, group difference) error {
+	labels := make([]string, len(c.servers))
+	sources := make([]memberSource, len(c.servers))
+	for i, server := range c.servers {
+		source, ok := server.(memberSource)
+		if !ok {
+			return fmt.Errorf("the members of %s can't be listed from %s", group.dn, server.label())
+		}
+		labels[i] = server.label()
+		sources[i] = source
+	}
+	for _, attribute := range memberAttributes {
+		err := mergeEntries(ctx, labels, func(ctx context.Context, i int, out chan<- ldapEntry) {
+			sources[i].listMembers(ctx, group.dn, group.fullDN, attribute, out)
+		}, func(member string, matched []ldapEntry) {
+			values := make([]string, len(matched))
+			missing := false
+			for i, entry := range matched {
+				values[i] = entry.dn_trunc
+				missing = missing || entry.dn_trunc == ""
+			}
+			if missing {
+				c.report(difference{dn: group.dn + " " + attribute + ": " + member, kind: memberMismatch, timestamps: values, expected: member})
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// rdnCharacters are the characters the partitions split on when dividing by the first character of the DN, which
+// is that of an attribute type in dn_trunc.
+const rdnCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// partitionsPerScan is the number of partitions for each concurrent scan.  Smaller partitions mean a slow one holds
+// up fewer of the others while they wait to be reported.
+const partitionsPerScan = 4
+
+// rdnBoundaries divides the DN space into n ranges on the first character of dn_trunc.  The ranges are only as
+// even as the RDN types of the directory, so sampled boundaries usually balance the work better.
+func rdnBoundaries(n int) []string {
+	if n > len(rdnCharacters) {
+		n = len(rdnCharacters)
+	}
+	var boundaries []string
+	for i := 1; i < n; i++ {
+		boundaries = append(boundaries, rdnCharacters[i*len(rdnCharacters)/n:i*len(rdnCharacters)/n+1])
+	}
+	return boundaries
+}
+
+// partitionRanges divides the DN space into ranges for the parallel comparison, either on the first character of
+// the DN or from boundaries sampled from the first server so each holds a similar number of entries.
+func (c *comparison) partitionRanges(ctx context.Context) ([]keyRange, error) {
+	n := c.options.parallel * partitionsPerScan
+	if c.options.partitionByRDN {
+		return splitRange(keyRange{}, rdnBoundaries(n)), nil
+	}
+	database, ok := c.servers[0].(*db2Source)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a DB2 database, boundaries can only be sampled from DB2", c.servers[0].label())
+	}
+	queryCtx, cancel := queryContext(ctx, database.queryTimeout)
+	defer cancel()
+	count, err := countEntries(queryCtx, database.conn, database.schema, keyRange{})
+	if err != nil {
+		return nil, fmt.Errorf("Error on Query: %v", err)
+	}
+	// Fewer entries than partitions aren't worth splitting, and none can't be sampled
+	if count < n {
+		return []keyRange{{}}, nil
+	}
+	boundaries, err := sampleBoundaries(queryCtx, database.conn, database.schema, keyRange{}, count, n)
+	if err != nil {
+		return nil, fmt.Errorf("Error on Query: %v", err)
+	}
+	return splitRange(keyRange{}, boundaries), nil
+}
+
+// partition is the part of a parallel comparison covering one range of DNs.
+type partition struct {
+	summary     *diffSummary
+	differences differenceList
+	flagged     []difference
+	groups      []difference
+	err         error
+	done        chan struct{}
+}
+
+// compareParallel compares the partitions of the DN space concurrently, each with its own range scan on every
+// server.  The differences of each partition are held back until those before it have been reported so the report
+// stays in DN order.  No more than options.parallel partitions are started ahead of the report, so those waiting
+// behind a slow one can't hold the differences of the whole directory in memory.
+func (c *comparison) compareParallel(ctx context.Context) error {
+	ranges, err := c.partitionRanges(ctx)
+	if err != nil {
+		return err
+	}
+	if verbose > 0 {
+		fmt.Fprintf(os.Stderr, "Comparing %d partitions in parallel\n", len(ranges))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	partitions := make([]*partition, len(ranges))
+	for i := range ranges {
+		partitions[i] = &partition{summary: newDiffSummary(c.summary.servers), done: make(chan struct{})}
+	}
+	// A partition takes a place in the window when it starts and gives it back once it has been reported
+	window := make(chan struct{}, c.options.parallel)
+	go func() {
+		for i, r := range ranges {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(p *partition, r keyRange) {
+				defer close(p.done)
+				part := &comparison{servers: c.servers, options: c.options, sink: &p.differences, summary: p.summary, checkpointed: time.Now()}
+				p.err = part.mergeRange(ctx, r)
+				p.flagged, p.groups = part.flagged, part.groups
+			}(partitions[i], r)
+		}
+	}()
+
+	for _, p := range partitions {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if p.err != nil {
+			return p.err
+		}
+		c.summary.merge(p.summary)
+		for _, d := range p.differences {
+			c.sink.writeDifference(d)
+		}
+		c.flagged = append(c.flagged, p.flagged...)
+		c.groups = append(c.groups, p.groups...)
+		p.differences = nil
+		<-window
+	}
+	return nil
+}
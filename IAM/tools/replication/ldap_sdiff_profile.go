@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profileAttribute is an attribute compared by a comparison profile.
+type profileAttribute struct {
+	name     string
+	dn       bool // values are DNs and are compared normalised
+	security bool // a difference is a security issue rather than replication noise
+}
+
+// comparisonProfiles are the groups of attributes that can be compared in place of the modify timestamps.
+var comparisonProfiles = map[string][]profileAttribute{
+	"acl": {
+		{name: "aclEntry", security: true},
+		{name: "aclPropagate", security: true},
+		{name: "entryOwner", dn: true, security: true},
+		{name: "ownerPropagate", security: true},
+		{name: "ibm-filterAclEntry", security: true},
+		{name: "ibm-filterAclInherit", security: true},
+	},
+	"pwdpolicy": {
+		{name: "pwdAccountLockedTime", security: true},
+		{name: "ibm-pwdAccountLocked", security: true},
+		{name: "pwdReset", security: true},
+		{name: "pwdPolicySubentry", dn: true, security: true},
+		{name: "ibm-pwdIndividualPolicyDN", dn: true, security: true},
+		{name: "pwdFailureTime"},
+		{name: "pwdChangedTime"},
+		{name: "pwdGraceUseTime"},
+	},
+	"groups": {
+		{name: "member", dn: true, security: true},
+		{name: "uniqueMember", dn: true, security: true},
+		{name: "memberURL", security: true},
+	},
+}
+
+// profileNames returns the names of the comparison profiles in order.
+func profileNames() []string {
+	var names []string
+	for name := range comparisonProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseProfiles returns the attributes of the comma separated profiles.
+func parseProfiles(profiles string) ([]profileAttribute, error) {
+	var attributes []profileAttribute
+	for _, name := range strings.Split(profiles, ",") {
+		profile, ok := comparisonProfiles[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q, expected %s", name, strings.Join(profileNames(), ", "))
+		}
+		attributes = append(attributes, profile...)
+	}
+	return attributes, nil
+}
+
+// profileAttributeNames returns the names of the attributes to request for the profile.
+func profileAttributeNames(profile []profileAttribute) []string {
+	names := make([]string, len(profile))
+	for i, attribute := range profile {
+		names[i] = attribute.name
+	}
+	return names
+}
+
+// profileValues reads the profile's attributes of an entry, keyed by lower-cased attribute name, in a canonical
+// form: the values sorted, DNs normalised, and joined.  Attributes the entry doesn't have are left out.
+func profileValues(profile []profileAttribute, get func(name string) []string) map[string]string {
+	if len(profile) == 0 {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, attribute := range profile {
+		attributeValues := get(attribute.name)
+		if len(attributeValues) == 0 {
+			continue
+		}
+		normalized := make([]string, len(attributeValues))
+		for i, value := range attributeValues {
+			if attribute.dn {
+				value = normalizeDN(value)
+			}
+			normalized[i] = strings.TrimSpace(value)
+		}
+		sort.Strings(normalized)
+		values[strings.ToLower(attribute.name)] = strings.Join(normalized, "; ")
+	}
+	return values
+}
+
+// compareProfile reports the profile attributes of one DN that differ between the servers.  An entry missing on
+// some servers is reported once as missing rather than for each attribute, and attribute differences on entries
+// whose timestamps show a change still replicating are reported as in flight.
+func (c *comparison) compareProfile(dn string, entries []ldapEntry, timestamps []string) {
+	d, found := classifyEntry(dn, timestamps, c.options.rules)
+	d.fullDN = entryDN(entries)
+	if found && len(d.missingOn()) > 0 {
+		c.report(d)
+		return
+	}
+	inFlight := c.options.rules.inFlight(timestamps)
+	for _, attribute := range c.options.profile {
+		key := strings.ToLower(attribute.name)
+		values := make([]string, len(entries))
+		held := false
+		for i, entry := range entries {
+			values[i] = entry.attributes[key]
+			held = held || values[i] != ""
+		}
+		if !held {
+			continue
+		}
+		d, found := classifyValues(dn+" "+attribute.name, values)
+		if !found {
+			continue
+		}
+		// An attribute held on only some of the servers is a difference in its value, not a missing entry.
+		switch {
+		case inFlight:
+			d.kind = changeInFlight
+		case attribute.security:
+			d.kind = securityMismatch
+		default:
+			d.kind = valueMismatch
+		}
+		c.report(d)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// diffKind classifies a difference found between the servers.
+type diffKind string
+
+const (
+	missingEntry      diffKind = "missing"
+	timestampMismatch diffKind = "mismatch"
+	changeInFlight    diffKind = "inflight"
+	notComparable     diffKind = "notcomparable"
+	valueMismatch     diffKind = "different"
+	securityMismatch  diffKind = "security"
+	memberMismatch    diffKind = "member"
+)
+
+// difference describes a single DN that is not consistent across the servers.  When comparing schema or
+// configuration the dn is the name of the element and the timestamps hold its values.
+type difference struct {
+	dn         string
+	fullDN     string // the DN of the entry as a server holds it, as dn is the dn_trunc key and can be truncated
+	kind       diffKind
+	timestamps []string // modify_timestamp on each server, "" where the entry is missing
+	expected   string   // the majority, or newest, modify_timestamp
+	group      bool     // the entry is a group, whose members are compared with --members
+}
+
+// missingOn returns the indexes of the servers that do not hold the entry.
+func (d difference) missingOn() []int {
+	var servers []int
+	for i, timestamp := range d.timestamps {
+		if timestamp == "" {
+			servers = append(servers, i)
+		}
+	}
+	return servers
+}
+
+// divergentOn returns the indexes of the servers that hold the entry with a timestamp other than the expected one.
+// For differing values a server without the value diverges too.  A server without a timestamp can't be said to
+// diverge.
+func (d difference) divergentOn() []int {
+	values := d.kind == valueMismatch || d.kind == securityMismatch
+	var servers []int
+	for i, timestamp := range d.timestamps {
+		if timestamp != d.expected && (values || (timestamp != "" && timestamp != unknownTimestamp)) {
+			servers = append(servers, i)
+		}
+	}
+	return servers
+}
+
+// formatTimestamps lists the timestamps seen on each server for messages.
+func formatTimestamps(timestamps []string) string {
+	formatted := make([]string, len(timestamps))
+	for i, timestamp := range timestamps {
+		formatted[i] = timestamp
+		if timestamp == "" {
+			formatted[i] = "(missing)"
+		}
+	}
+	return strings.Join(formatted, " != ")
+}
+
+// serverList describes a set of servers for messages, e.g. "second, third server".
+func serverList(servers []int) string {
+	var names []string
+	for _, i := range servers {
+		names = append(names, serverOrdinal(i))
+	}
+	if len(names) == 1 {
+		return names[0] + " server"
+	}
+	return strings.Join(names, ", ") + " servers"
+}
+
+// diffSummary holds the totals reported at the end of a comparison.
+type diffSummary struct {
+	subject    string // what is compared, "" for entries, otherwise e.g. "schema"
+	profiles   string // the attribute profiles compared, "" when comparing timestamps
+	servers    []string
+	compared   int
+	missing    []int // entries missing on each server
+	divergent  []int // entries on each server whose timestamp differs from the expected one
+	mismatches int
+	// missingEntries counts the DNs missing on at least one server
+	missingEntries int
+	changed        int // schema, configuration or attribute values that differ
+	security       int // security-relevant attribute values that differ
+	members        int // group members missing on some servers
+	inFlight       int // differences put down to replication lag
+	notComparable  int // entries without a timestamp on some server, so they can't be compared
+	resolved       int // differences that had gone by the time they were rechecked
+	started        time.Time
+	elapsed        time.Duration
+	interrupted    bool   // the comparison was stopped before it finished
+	aborted        string // the error the comparison failed with, "" when it didn't
+}
+
+func newDiffSummary(servers []string) *diffSummary {
+	return &diffSummary{
+		servers:   servers,
+		missing:   make([]int, len(servers)),
+		divergent: make([]int, len(servers)),
+		started:   time.Now(),
+	}
+}
+
+// add records a difference in the totals.
+func (s *diffSummary) add(d difference) {
+	switch d.kind {
+	case changeInFlight:
+		s.inFlight++
+		return
+	case notComparable:
+		s.notComparable++
+		return
+	case memberMismatch:
+		// The group itself has already been counted as a mismatch.
+		s.members++
+		return
+	}
+	if d.kind == missingEntry {
+		for _, i := range d.missingOn() {
+			s.missing[i]++
+		}
+	}
+	for _, i := range d.divergentOn() {
+		s.divergent[i]++
+	}
+	switch d.kind {
+	case missingEntry:
+		s.missingEntries++
+	case timestampMismatch:
+		s.mismatches++
+	case valueMismatch:
+		s.changed++
+	case securityMismatch:
+		s.security++
+	}
+}
+
+// merge adds in the totals of a summary covering part of the comparison.
+func (s *diffSummary) merge(part *diffSummary) {
+	s.compared += part.compared
+	s.missingEntries += part.missingEntries
+	s.mismatches += part.mismatches
+	s.changed += part.changed
+	s.security += part.security
+	s.members += part.members
+	s.inFlight += part.inFlight
+	s.notComparable += part.notComparable
+	s.resolved += part.resolved
+	for i := range s.servers {
+		s.missing[i] += part.missing[i]
+		s.divergent[i] += part.divergent[i]
+	}
+}
+
+// differences returns the number of DNs that were reported as differing, not counting changes in flight.
+func (s *diffSummary) differences() int {
+	return s.missingEntries + s.mismatches + s.changed + s.security
+}
+
+// differenceSink receives each difference as the comparison finds it.
+type differenceSink interface {
+	writeDifference(d difference)
+}
+
+// differenceList is a differenceSink collecting the differences in memory.
+type differenceList []difference
+
+func (l *differenceList) writeDifference(d difference) {
+	*l = append(*l, d)
+}
+
+// DiffWriter reports the differences found by the comparison in a particular output format.
+type DiffWriter interface {
+	writeHeader(summary *diffSummary)
+	differenceSink
+	writeSummary(summary *diffSummary)
+}
+
+// newDiffWriter returns the DiffWriter for the named format writing to out.
+func newDiffWriter(format string, out io.Writer) (DiffWriter, error) {
+	switch strings.ToLower(format) {
+	case "text":
+		return &textDiffWriter{out: out}, nil
+	case "csv":
+		return &csvDiffWriter{out: csv.NewWriter(out)}, nil
+	case "json":
+		return &jsonDiffWriter{out: out}, nil
+	case "ndjson":
+		return &jsonDiffWriter{out: out, lines: true}, nil
+	case "junit":
+		return &junitDiffWriter{out: out}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, expected one of text, csv, json, ndjson or junit", format)
+}
+
+var ordinals = []string{"first", "second", "third", "fourth", "fifth", "sixth", "seventh", "eighth"}
+
+// serverOrdinal returns "first", "second", ... for the server at index i.
+func serverOrdinal(i int) string {
+	if i < len(ordinals) {
+		return ordinals[i]
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+type textDiffWriter struct {
+	out      io.Writer
+	security []difference // security-relevant differences, reported in a section of their own
+}
+
+func (t *textDiffWriter) writeHeader(summary *diffSummary) {
+	if summary.subject != "" {
+		title := fmt.Sprintf("Reporting %s differences", summary.subject)
+		fmt.Fprintln(t.out, title)
+		fmt.Fprintln(t.out, strings.Repeat("-", len(title)))
+		return
+	}
+	if summary.profiles != "" {
+		title := fmt.Sprintf("Reporting %s attributes for any conflicting entries", summary.profiles)
+		fmt.Fprintln(t.out, title)
+		fmt.Fprintln(t.out, strings.Repeat("-", len(title)))
+		return
+	}
+	fmt.Fprintln(t.out, "Reporting dn_trunc and modify_timestamp for any conflicting entries")
+	fmt.Fprintln(t.out, "-------------------------------------------------------------------")
+}
+
+func (t *textDiffWriter) writeDifference(d difference) {
+	switch d.kind {
+	case missingEntry:
+		for _, i := range d.missingOn() {
+			fmt.Fprintf(t.out, "Missing entry on %s server: %s\n", serverOrdinal(i), d.dn)
+		}
+		if divergent := d.divergentOn(); len(divergent) > 0 {
+			fmt.Fprintf(t.out, "  and diverging timestamps on %s (expected %s)\n", serverList(divergent), d.expected)
+		}
+	case timestampMismatch:
+		fmt.Fprintf(t.out, "Mismatching timestamps for %s: %s\n", d.dn, formatTimestamps(d.timestamps))
+		if len(d.timestamps) > 2 {
+			fmt.Fprintf(t.out, "  diverging on %s (expected %s)\n", serverList(d.divergentOn()), d.expected)
+		}
+	case changeInFlight:
+		fmt.Fprintf(t.out, "Change in flight for %s: %s\n", d.dn, formatTimestamps(d.timestamps))
+	case notComparable:
+		fmt.Fprintf(t.out, "No modifyTimestamp to compare for %s: %s\n", d.dn, formatTimestamps(d.timestamps))
+	case valueMismatch:
+		fmt.Fprintf(t.out, "Differing values for %s: %s\n", d.dn, formatTimestamps(d.timestamps))
+		if len(d.timestamps) > 2 {
+			fmt.Fprintf(t.out, "  diverging on %s (expected %s)\n", serverList(d.divergentOn()), d.expected)
+		}
+	case securityMismatch:
+		t.security = append(t.security, d)
+	case memberMismatch:
+		fmt.Fprintf(t.out, "Group member missing on %s: %s\n", serverList(d.missingOn()), d.dn)
+	}
+}
+
+func (t *textDiffWriter) writeSummary(summary *diffSummary) {
+	if len(t.security) > 0 {
+		fmt.Fprintln(t.out, "")
+		fmt.Fprintln(t.out, "Security-relevant differences")
+		fmt.Fprintln(t.out, "-----------------------------")
+		for _, d := range t.security {
+			fmt.Fprintf(t.out, "Differing values for %s: %s\n", d.dn, formatTimestamps(d.timestamps))
+			fmt.Fprintf(t.out, "  diverging on %s (expected %s)\n", serverList(d.divergentOn()), d.expected)
+		}
+	}
+	fmt.Fprintln(t.out, "")
+	fmt.Fprintln(t.out, "Summary")
+	fmt.Fprintln(t.out, "-------")
+	if summary.subject != "" {
+		fmt.Fprintf(t.out, "  Definitions compared: %d\n", summary.compared)
+		fmt.Fprintf(t.out, "  Missing on some servers: %d\n", summary.missingEntries)
+		fmt.Fprintf(t.out, "  Differing values: %d\n", summary.changed)
+	} else if summary.profiles != "" {
+		fmt.Fprintf(t.out, "  Entries compared: %d (profiles %s)\n", summary.compared, summary.profiles)
+		fmt.Fprintf(t.out, "  Entries missing on some servers: %d\n", summary.missingEntries)
+		fmt.Fprintf(t.out, "  Differing values: %d\n", summary.changed)
+		fmt.Fprintf(t.out, "  Security-relevant differences: %d\n", summary.security)
+		fmt.Fprintf(t.out, "  Changes in flight: %d\n", summary.inFlight)
+	} else {
+		fmt.Fprintf(t.out, "  Entries compared: %d\n", summary.compared)
+		fmt.Fprintf(t.out, "  Entries missing on some servers: %d\n", summary.missingEntries)
+		fmt.Fprintf(t.out, "  Timestamp mismatches: %d\n", summary.mismatches)
+		fmt.Fprintf(t.out, "  Changes in flight: %d\n", summary.inFlight)
+	}
+	if summary.notComparable > 0 {
+		fmt.Fprintf(t.out, "  Not comparable, without modifyTimestamp: %d\n", summary.notComparable)
+	}
+	if summary.members > 0 {
+		fmt.Fprintf(t.out, "  Group member differences: %d\n", summary.members)
+	}
+	if summary.resolved > 0 {
+		fmt.Fprintf(t.out, "  Resolved on recheck: %d\n", summary.resolved)
+	}
+	if summary.interrupted {
+		fmt.Fprintln(t.out, "  Interrupted: the comparison did not finish")
+	}
+	if summary.aborted != "" {
+		fmt.Fprintf(t.out, "  Aborted: the comparison did not finish: %s\n", summary.aborted)
+	}
+	for i, server := range summary.servers {
+		fmt.Fprintf(t.out, "  %s server (%s): %d missing, %d diverging\n",
+			strings.Title(serverOrdinal(i)), server, summary.missing[i], summary.divergent[i])
+	}
+	fmt.Fprintf(t.out, "  Elapsed time: %v\n", summary.elapsed.Round(time.Millisecond))
+}
+
+// csvDiffWriter writes one row per difference.  The summary goes to stderr so the output stays loadable as CSV.
+type csvDiffWriter struct {
+	out *csv.Writer
+}
+
+func (t *csvDiffWriter) writeHeader(summary *diffSummary) {
+	header := []string{"dn", "status"}
+	column := "modifyTimestamp%d"
+	if summary.subject != "" {
+		header[0] = "name"
+	}
+	if summary.subject != "" || summary.profiles != "" {
+		column = "value%d"
+	}
+	for i := range summary.servers {
+		header = append(header, fmt.Sprintf(column, i+1))
+	}
+	t.out.Write(append(header, "expected"))
+}
+
+func (t *csvDiffWriter) writeDifference(d difference) {
+	record := append([]string{d.dn, string(d.kind)}, d.timestamps...)
+	t.out.Write(append(record, d.expected))
+}
+
+func (t *csvDiffWriter) writeSummary(summary *diffSummary) {
+	t.out.Flush()
+	(&textDiffWriter{out: os.Stderr}).writeSummary(summary)
+}
+
+type jsonDifference struct {
+	DN         string   `json:"dn,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Status     diffKind `json:"status"`
+	Timestamps []string `json:"modifyTimestamps,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	Expected   string   `json:"expected"`
+	Missing    []int    `json:"missingOn,omitempty"`
+	Divergent  []int    `json:"divergentOn,omitempty"`
+}
+
+// serverNumbers converts server indexes to the 1-based numbers used on the command line.
+func serverNumbers(servers []int) []int {
+	numbers := make([]int, len(servers))
+	for i, server := range servers {
+		numbers[i] = server + 1
+	}
+	return numbers
+}
+
+type jsonSummary struct {
+	Subject             string   `json:"subject,omitempty"`
+	Profiles            string   `json:"profiles,omitempty"`
+	Servers             []string `json:"servers"`
+	EntriesCompared     int      `json:"entriesCompared"`
+	MissingEntries      int      `json:"missingEntries"`
+	TimestampMismatches int      `json:"timestampMismatches"`
+	DifferingValues     int      `json:"differingValues"`
+	SecurityDifferences int      `json:"securityDifferences"`
+	MemberDifferences   int      `json:"memberDifferences"`
+	InFlight            int      `json:"inFlight"`
+	NotComparable       int      `json:"notComparable,omitempty"`
+	Resolved            int      `json:"resolvedOnRecheck"`
+	Missing             []int    `json:"missing"`
+	Divergent           []int    `json:"divergent"`
+	ElapsedSeconds      float64  `json:"elapsedSeconds"`
+	DifferencesFound    bool     `json:"differencesFound"`
+	Interrupted         bool     `json:"interrupted,omitempty"`
+	Aborted             string   `json:"aborted,omitempty"`
+}
+
+func newJSONSummary(summary *diffSummary) jsonSummary {
+	return jsonSummary{
+		Subject:             summary.subject,
+		Profiles:            summary.profiles,
+		Servers:             summary.servers,
+		EntriesCompared:     summary.compared,
+		MissingEntries:      summary.missingEntries,
+		TimestampMismatches: summary.mismatches,
+		DifferingValues:     summary.changed,
+		SecurityDifferences: summary.security,
+		MemberDifferences:   summary.members,
+		InFlight:            summary.inFlight,
+		NotComparable:       summary.notComparable,
+		Resolved:            summary.resolved,
+		Missing:             summary.missing,
+		Divergent:           summary.divergent,
+		ElapsedSeconds:      summary.elapsed.Seconds(),
+		DifferencesFound:    summary.differences() > 0,
+		Interrupted:         summary.interrupted,
+		Aborted:             summary.aborted,
+	}
+}
+
+// jsonDiffWriter streams the differences either as one JSON document or, with lines set, as NDJSON records.
+type jsonDiffWriter struct {
+	out    io.Writer
+	lines  bool
+	count  int
+	names  bool // differences are of schema or configuration elements rather than entries
+	values bool // differences are of values rather than timestamps
+}
+
+func (t *jsonDiffWriter) writeHeader(summary *diffSummary) {
+	t.names = summary.subject != ""
+	t.values = t.names || summary.profiles != ""
+	if !t.lines {
+		serverList, _ := json.Marshal(summary.servers)
+		fmt.Fprintf(t.out, "{\"servers\":%s,\"differences\":[", serverList)
+	}
+}
+
+func (t *jsonDiffWriter) writeDifference(d difference) {
+	jd := jsonDifference{
+		Status:    d.kind,
+		Expected:  d.expected,
+		Missing:   serverNumbers(d.missingOn()),
+		Divergent: serverNumbers(d.divergentOn()),
+	}
+	if t.names {
+		jd.Name = d.dn
+	} else {
+		jd.DN = d.dn
+	}
+	if t.values {
+		jd.Values = d.timestamps
+	} else {
+		jd.Timestamps = d.timestamps
+	}
+	record, _ := json.Marshal(jd)
+	switch {
+	case t.lines:
+		fmt.Fprintf(t.out, "%s\n", record)
+	case t.count == 0:
+		fmt.Fprintf(t.out, "\n%s", record)
+	default:
+		fmt.Fprintf(t.out, ",\n%s", record)
+	}
+	t.count++
+}
+
+func (t *jsonDiffWriter) writeSummary(summary *diffSummary) {
+	if t.lines {
+		record, _ := json.Marshal(struct {
+			Summary jsonSummary `json:"summary"`
+		}{newJSONSummary(summary)})
+		fmt.Fprintf(t.out, "%s\n", record)
+		return
+	}
+	record, _ := json.Marshal(newJSONSummary(summary))
+	fmt.Fprintf(t.out, "\n],\"summary\":%s}\n", record)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Skipped   *junitSkipped `xml:"skipped"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+// junitDiffWriter reports each difference as a failed test case, and changes in flight and entries that can't be
+// compared as skipped ones.  The suite totals are only known at the end so the test cases are held until
+// writeSummary.  The totals count the test cases, so they agree with them however many are written for an entry;
+// the number of entries compared is reported as the entriesCompared property.
+type junitDiffWriter struct {
+	out       io.Writer
+	testCases []junitTestCase
+}
+
+func (t *junitDiffWriter) writeHeader(summary *diffSummary) {
+}
+
+func (t *junitDiffWriter) writeDifference(d difference) {
+	if d.kind == changeInFlight || d.kind == notComparable {
+		message := "Change in flight: "
+		if d.kind == notComparable {
+			message = "No modifyTimestamp to compare: "
+		}
+		t.testCases = append(t.testCases, junitTestCase{
+			Name:      d.dn,
+			ClassName: "ldap_sdiff." + string(d.kind),
+			Skipped:   &junitSkipped{Message: message + formatTimestamps(d.timestamps)},
+		})
+		return
+	}
+	var message string
+	switch d.kind {
+	case missingEntry:
+		message = fmt.Sprintf("Missing entry on %s", serverList(d.missingOn()))
+	case timestampMismatch:
+		message = fmt.Sprintf("Mismatching timestamps: %s, diverging on %s (expected %s)",
+			formatTimestamps(d.timestamps), serverList(d.divergentOn()), d.expected)
+	case valueMismatch:
+		message = fmt.Sprintf("Differing values: %s, diverging on %s (expected %s)",
+			formatTimestamps(d.timestamps), serverList(d.divergentOn()), d.expected)
+	case securityMismatch:
+		message = fmt.Sprintf("Security-relevant values differ: %s, diverging on %s (expected %s)",
+			formatTimestamps(d.timestamps), serverList(d.divergentOn()), d.expected)
+	case memberMismatch:
+		message = fmt.Sprintf("Group member missing on %s", serverList(d.missingOn()))
+	}
+	t.testCases = append(t.testCases, junitTestCase{
+		Name:      d.dn,
+		ClassName: "ldap_sdiff." + string(d.kind),
+		Failure:   &junitFailure{Message: message, Type: string(d.kind)},
+	})
+}
+
+func (t *junitDiffWriter) writeSummary(summary *diffSummary) {
+	properties := []junitProperty{{Name: "entriesCompared", Value: fmt.Sprint(summary.compared)}}
+	for i, server := range summary.servers {
+		properties = append(properties,
+			junitProperty{Name: fmt.Sprintf("server%d", i+1), Value: server},
+			junitProperty{Name: fmt.Sprintf("missing%d", i+1), Value: fmt.Sprint(summary.missing[i])},
+			junitProperty{Name: fmt.Sprintf("divergent%d", i+1), Value: fmt.Sprint(summary.divergent[i])})
+	}
+	properties = append(properties,
+		junitProperty{Name: "missingEntries", Value: fmt.Sprint(summary.missingEntries)},
+		junitProperty{Name: "timestampMismatches", Value: fmt.Sprint(summary.mismatches)},
+		junitProperty{Name: "differingValues", Value: fmt.Sprint(summary.changed)},
+		junitProperty{Name: "securityDifferences", Value: fmt.Sprint(summary.security)},
+		junitProperty{Name: "memberDifferences", Value: fmt.Sprint(summary.members)},
+		junitProperty{Name: "inFlight", Value: fmt.Sprint(summary.inFlight)},
+		junitProperty{Name: "notComparable", Value: fmt.Sprint(summary.notComparable)},
+		junitProperty{Name: "resolvedOnRecheck", Value: fmt.Sprint(summary.resolved)},
+		junitProperty{Name: "interrupted", Value: fmt.Sprint(summary.interrupted)})
+	// An aborted comparison fails the suite whether or not any differences were found before it stopped
+	if summary.aborted != "" {
+		properties = append(properties, junitProperty{Name: "aborted", Value: summary.aborted})
+		t.testCases = append(t.testCases, junitTestCase{
+			Name:      "comparison",
+			ClassName: "ldap_sdiff.aborted",
+			Failure:   &junitFailure{Message: "Comparison aborted: " + summary.aborted, Type: "aborted"},
+		})
+	}
+	var failures, skipped int
+	for _, testCase := range t.testCases {
+		if testCase.Failure != nil {
+			failures++
+		}
+		if testCase.Skipped != nil {
+			skipped++
+		}
+	}
+	suite := junitTestSuite{
+		Name:       "ldap_sdiff",
+		Tests:      len(t.testCases),
+		Failures:   failures,
+		Skipped:    skipped,
+		Time:       fmt.Sprintf("%.3f", summary.elapsed.Seconds()),
+		Timestamp:  summary.started.UTC().Format("2006-01-02T15:04:05"),
+		Properties: properties,
+		TestCases:  t.testCases,
+	}
+	fmt.Fprint(t.out, xml.Header)
+	encoder := xml.NewEncoder(t.out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suite); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing JUnit report: ", err.Error())
+	}
+	fmt.Fprintln(t.out, "")
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaDN is the subschema entry read from each server.
+const schemaDN = "cn=schema"
+
+// schemaAttributes are the cn=schema attributes compared, with the name their definitions are reported under.
+var schemaAttributes = []struct {
+	attribute string
+	kind      string
+}{
+	{"attributeTypes", "attributeType"},
+	{"objectClasses", "objectClass"},
+	{"matchingRules", "matchingRule"},
+	{"ldapSyntaxes", "ldapSyntax"},
+	{"ibmAttributeTypes", "index"},
+}
+
+// orderedClauses are the definition keywords whose lists are positional and so are not sorted.
+var orderedClauses = map[string]bool{"DBNAME": true}
+
+// defaultIgnoredConfig are the ibmslapd.conf attributes that always differ between instances, as their values
+// are encrypted with a key unique to each instance.
+const defaultIgnoredConfig = "ibm-slapdAdminPW,ibm-slapdDbUserPW"
+
+// tokenizeDefinition splits an RFC 4512 definition into parentheses, quoted strings (with their quotes) and words.
+func tokenizeDefinition(definition string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(definition); {
+		switch c := definition[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '\'':
+			end := strings.IndexByte(definition[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			tokens = append(tokens, definition[i:i+end+2])
+			i += end + 2
+		default:
+			end := strings.IndexAny(definition[i:], " \t\r\n()'")
+			if end < 0 {
+				end = len(definition) - i
+			}
+			tokens = append(tokens, definition[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// isDefinitionKeyword reports whether a word starts a new clause, such as NAME, SUP or X-ORIGIN.
+func isDefinitionKeyword(word string) bool {
+	if word == "" || word[0] < 'A' || word[0] > 'Z' {
+		return false
+	}
+	for _, c := range word {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalDefinition returns the OID of a schema definition and a canonical form of it in which the clauses and
+// unordered lists are sorted and everything apart from descriptions is lower-cased, so definitions that differ
+// only in ordering, spacing or case compare equal.
+func canonicalDefinition(definition string) (string, string, error) {
+	tokens, err := tokenizeDefinition(definition)
+	if err != nil {
+		return "", "", err
+	}
+	if len(tokens) < 3 || tokens[0] != "(" || tokens[len(tokens)-1] != ")" {
+		return "", "", fmt.Errorf("definition is not enclosed in parentheses")
+	}
+	oid := strings.ToLower(tokens[1])
+	var clauses []string
+	keyword := ""
+	clause := ""
+	flushClause := func() {
+		if clause != "" {
+			clauses = append(clauses, clause)
+		}
+	}
+	for i := 2; i < len(tokens)-1; i++ {
+		token := tokens[i]
+		if isDefinitionKeyword(token) {
+			flushClause()
+			keyword = token
+			clause = token
+			continue
+		}
+		normalize := strings.ToLower
+		if keyword == "DESC" {
+			normalize = func(s string) string { return s }
+		}
+		if token != "(" {
+			clause += " " + normalize(token)
+			continue
+		}
+		var list []string
+		for i++; i < len(tokens)-1 && tokens[i] != ")"; i++ {
+			if tokens[i] != "$" {
+				list = append(list, normalize(tokens[i]))
+			}
+		}
+		if !orderedClauses[keyword] {
+			sort.Strings(list)
+		}
+		clause += " ( " + strings.Join(list, " ") + " )"
+	}
+	flushClause()
+	sort.Strings(clauses)
+	return oid, "( " + oid + " " + strings.Join(clauses, " ") + " )", nil
+}
+
+// schemaDefinitions canonicalises the values of the schema attributes, keyed by kind and OID.
+func schemaDefinitions(attributes map[string][]string) (map[string]string, error) {
+	definitions := make(map[string]string)
+	for _, schema := range schemaAttributes {
+		for _, value := range attributes[strings.ToLower(schema.attribute)] {
+			oid, canonical, err := canonicalDefinition(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s definition %q: %v", schema.kind, value, err)
+			}
+			definitions[schema.kind+" "+oid] = canonical
+		}
+	}
+	return definitions, nil
+}
+
+// readLDAPSchema fetches the schema definitions published by a server in cn=schema.
+func readLDAPSchema(conn *ldap.Conn) (map[string][]string, error) {
+	names := make([]string, len(schemaAttributes))
+	for i, schema := range schemaAttributes {
+		names[i] = schema.attribute
+	}
+	request := ldap.NewSearchRequest(schemaDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", names, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, fmt.Errorf("%s not found", schemaDN)
+	}
+	attributes := make(map[string][]string)
+	for _, name := range names {
+		attributes[strings.ToLower(name)] = result.Entries[0].GetEqualFoldAttributeValues(name)
+	}
+	return attributes, nil
+}
+
+// readLDIFSchema reads the schema definitions from the cn=schema records of an LDIF file, such as an export of
+// cn=schema or a V3.modifiedschema file.
+func readLDIFSchema(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	attributes := make(map[string][]string)
+	err = readLDIF(f, func(dn string, record map[string][]string) error {
+		if normalizeDN(dn) != strings.ToUpper(schemaDN) {
+			return nil
+		}
+		for name, values := range record {
+			attributes[name] = append(attributes[name], values...)
+		}
+		return nil
+	})
+	return attributes, err
+}
+
+// readConfig reads an ibmslapd.conf file into values keyed by entry DN and by entry DN and attribute name, along
+// with the entry each attribute belongs to.  Attribute values have their whitespace collapsed and are sorted so
+// only semantic differences are reported.
+func readConfig(filename string, ignored map[string]bool) (map[string]string, map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	owners := make(map[string]string)
+	err = readLDIF(f, func(dn string, attributes map[string][]string) error {
+		entry := normalizeDN(dn)
+		for name, attributeValues := range attributes {
+			normalized := make([]string, len(attributeValues))
+			for i, value := range attributeValues {
+				normalized[i] = strings.Join(strings.Fields(value), " ")
+				if name == "objectclass" {
+					normalized[i] = strings.ToLower(normalized[i])
+				}
+			}
+			sort.Strings(normalized)
+			if name == "objectclass" {
+				values[entry] = "objectclass: " + strings.Join(normalized, ", ")
+				continue
+			}
+			if ignored[name] {
+				continue
+			}
+			key := entry + " " + name
+			values[key] = strings.Join(normalized, "; ")
+			owners[key] = entry
+		}
+		if values[entry] == "" {
+			values[entry] = "objectclass:"
+		}
+		return nil
+	})
+	return values, owners, err
+}
+
+// compareDefinitions reports every name whose value is missing on some sources or not the same on all of them.
+// An attribute of an entry missing on some sources is only reported when it also differs between the sources
+// that do have the entry, as the entry itself has already been reported.
+func compareDefinitions(sources []map[string]string, owners map[string]string, writer DiffWriter, summary *diffSummary) {
+	writer.writeHeader(summary)
+	seen := make(map[string]bool)
+	var names []string
+	for _, source := range sources {
+		for name := range source {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		summary.compared++
+		values := make([]string, len(sources))
+		for i, source := range sources {
+			values[i] = source[name]
+		}
+		d, found := classifyValues(name, values)
+		if !found {
+			continue
+		}
+		if owner, ok := owners[name]; ok {
+			var present []string
+			for i, source := range sources {
+				if source[owner] != "" {
+					present = append(present, values[i])
+				}
+			}
+			if len(present) < len(sources) {
+				if _, differs := classifyValues(name, present); !differs {
+					continue
+				}
+			}
+		}
+		if d.kind == timestampMismatch {
+			d.kind = valueMismatch
+		}
+		summary.add(d)
+		writer.writeDifference(d)
+	}
+}
+
+// reportDefinitions writes the comparison of the sources in the requested format and exits with the status of
+// the comparison.
+func reportDefinitions(subject string, labels []string, sources []map[string]string, owners map[string]string,
+	format string, outputFile string) {
+	out := os.Stdout
+	if outputFile != "" {
+		var err error
+		out, err = os.Create(outputFile)
+		if err != nil {
+			fmt.Printf("Unable to create %s: %v\n", outputFile, err)
+			os.Exit(exitError)
+		}
+	}
+	writer, err := newDiffWriter(format, out)
+	if err != nil {
+		DoDefinitionsUsage(subject, fmt.Sprintf("%s: error: %v\n", os.Args[0], err))
+	}
+	summary := newDiffSummary(labels)
+	summary.subject = subject
+	compareDefinitions(sources, owners, writer, summary)
+	summary.elapsed = time.Since(summary.started)
+	writer.writeSummary(summary)
+	out.Close()
+	if summary.differences() > 0 {
+		os.Exit(exitDifferencesFound)
+	}
+	os.Exit(exitConsistent)
+}
+
+// countSources returns the number of contiguously numbered sources given, exiting with the usage when there are
+// fewer than two or there is a gap in the numbering.
+func countSources(subject string, defined func(i int) bool) int {
+	count := 0
+	for count < maxServers && defined(count) {
+		count++
+	}
+	if count < 2 {
+		DoDefinitionsUsage(subject, fmt.Sprintf("%s: error: at least two sources are required\n", os.Args[0]))
+	}
+	for i := count; i < maxServers; i++ {
+		if defined(i) {
+			DoDefinitionsUsage(subject, fmt.Sprintf("%s: error: source %d given without source %d\n", os.Args[0], i+1, count+1))
+		}
+	}
+	return count
+}
+
+// schemaMain compares the schema of directory servers, read over LDAP or from LDIF files.
+func schemaMain(arguments []string) {
+	fs := flag.NewFlagSet("ldap_sdiff schema", flag.ContinueOnError)
+	ldapURLs := make([]*string, maxServers)
+	bindDNs := make([]*string, maxServers)
+	bindPWs := make([]*string, maxServers)
+	ldifs := make([]*string, maxServers)
+	for i := 0; i < maxServers; i++ {
+		n := i + 1
+		ldapURLs[i] = fs.String(fmt.Sprintf("ldap_url%d", n), "", "Read the schema from this server, e.g. ldaps://host:636.")
+		bindDNs[i] = fs.String(fmt.Sprintf("binddn%d", n), "", "DN to bind as (defaults to an anonymous bind).")
+		bindPWs[i] = fs.String(fmt.Sprintf("bindpw%d", n), "", "Password of the bind DN.")
+		ldifs[i] = fs.String(fmt.Sprintf("ldif%d", n), "", "Read the schema from the cn=schema records of this LDIF file.")
+	}
+	tlsInsecureArg := fs.Bool("tls_insecure", false, "Don't verify the certificates of LDAPS servers.")
+	formatArg := fs.String("format", "text", "Report format: text, csv, json, ndjson or junit (defaults to text).")
+	outputFileArg := fs.String("output_file", "", "Output file for the report (defaults to stdout).")
+	verboseArg := fs.Int("verbose", 0, "Level of debugging (defaults to 0 - none).")
+	help := fs.Bool("help", false, "Display the full help text")
+
+	if err := fs.Parse(arguments); err != nil {
+		os.Exit(exitError)
+	}
+	if *help {
+		DoHelp()
+	}
+	verbose = *verboseArg
+
+	count := countSources("schema", func(i int) bool { return *ldapURLs[i] != "" || *ldifs[i] != "" })
+	labels := make([]string, count)
+	sources := make([]map[string]string, count)
+	for i := 0; i < count; i++ {
+		var attributes map[string][]string
+		var err error
+		if *ldifs[i] != "" {
+			labels[i] = "ldif:" + *ldifs[i]
+			attributes, err = readLDIFSchema(*ldifs[i])
+		} else {
+			labels[i] = *ldapURLs[i]
+			var conn *ldap.Conn
+			conn, err = connectLDAP(*ldapURLs[i], *bindDNs[i], *bindPWs[i], *tlsInsecureArg, 0)
+			if err == nil {
+				attributes, err = readLDAPSchema(conn)
+				conn.Close()
+			}
+		}
+		if err == nil {
+			sources[i], err = schemaDefinitions(attributes)
+		}
+		if err != nil {
+			fmt.Printf("Unable to read the schema of %s: %v\n", labels[i], err)
+			os.Exit(exitError)
+		}
+		if verbose > 0 {
+			fmt.Fprintf(os.Stderr, "Read %d schema definitions from %s\n", len(sources[i]), labels[i])
+		}
+	}
+	reportDefinitions("schema", labels, sources, nil, *formatArg, *outputFileArg)
+}
+
+// configMain compares ibmslapd.conf files entry by entry and attribute by attribute.
+func configMain(arguments []string) {
+	fs := flag.NewFlagSet("ldap_sdiff config", flag.ContinueOnError)
+	configs := make([]*string, maxServers)
+	for i := 0; i < maxServers; i++ {
+		configs[i] = fs.String(fmt.Sprintf("config%d", i+1), "", "ibmslapd.conf file to compare.")
+	}
+	ignoreArg := fs.String("ignore", defaultIgnoredConfig, "Comma separated attributes not compared (defaults to "+defaultIgnoredConfig+").")
+	formatArg := fs.String("format", "text", "Report format: text, csv, json, ndjson or junit (defaults to text).")
+	outputFileArg := fs.String("output_file", "", "Output file for the report (defaults to stdout).")
+	verboseArg := fs.Int("verbose", 0, "Level of debugging (defaults to 0 - none).")
+	help := fs.Bool("help", false, "Display the full help text")
+
+	if err := fs.Parse(arguments); err != nil {
+		os.Exit(exitError)
+	}
+	if *help {
+		DoHelp()
+	}
+	verbose = *verboseArg
+
+	ignored := make(map[string]bool)
+	for _, name := range strings.Split(*ignoreArg, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ignored[strings.ToLower(name)] = true
+		}
+	}
+
+	count := countSources("config", func(i int) bool { return *configs[i] != "" })
+	labels := make([]string, count)
+	sources := make([]map[string]string, count)
+	owners := make(map[string]string)
+	for i := 0; i < count; i++ {
+		labels[i] = *configs[i]
+		values, entries, err := readConfig(*configs[i], ignored)
+		if err != nil {
+			fmt.Printf("Unable to read %s: %v\n", labels[i], err)
+			os.Exit(exitError)
+		}
+		sources[i] = values
+		for key, entry := range entries {
+			owners[key] = entry
+		}
+	}
+	reportDefinitions("config", labels, sources, owners, *formatArg, *outputFileArg)
+}
+
+// DoDefinitionsUsage prints the usage of the schema and config modes and exits.
+func DoDefinitionsUsage(subject string, message string) {
+	if subject == "schema" {
+		fmt.Println(strings.TrimSpace(`
+usage: ldap_sdiff.go schema [-h] {--ldap_url1 LDAP_URL [--binddn1 BINDDN --bindpw1 BINDPW],--ldif1 LDIF_FILE}
+                       {--ldap_url2 LDAP_URL [--binddn2 BINDDN --bindpw2 BINDPW],--ldif2 LDIF_FILE}
+                       [{--ldap_urlN LDAP_URL [--binddnN BINDDN --bindpwN BINDPW],--ldifN LDIF_FILE} ...]
+                       [--tls_insecure] [--format {text,csv,json,ndjson,junit}] [--output_file OUTPUT_FILE]
+`))
+	} else {
+		fmt.Println(strings.TrimSpace(`
+usage: ldap_sdiff.go config [-h] --config1 IBMSLAPD_CONF --config2 IBMSLAPD_CONF [--configN IBMSLAPD_CONF ...]
+                       [--ignore ATTRIBUTES] [--format {text,csv,json,ndjson,junit}] [--output_file OUTPUT_FILE]
+`))
+	}
+	if message != "" {
+		fmt.Println(message)
+	}
+	os.Exit(1)
+}
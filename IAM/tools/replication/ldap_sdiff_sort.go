@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"io"
+	"os"
+	"sort"
+)
+
+// sortRecord is the form entries take in the temporary run files of an external sort.
+type sortRecord struct {
+	Key        string
+	DN         string
+	Timestamp  string
+	Attributes map[string]string
+	Group      bool
+}
+
+// externalSorter sorts entries by dn_trunc for sources that can't return them in order.  Entries are held in
+// memory until chunkSize is reached, then each chunk is sorted and spilled to a temporary run file, and the runs
+// are merged back together when the sorted entries are read.
+type externalSorter struct {
+	chunkSize int
+	buffer    []ldapEntry
+	runs      []*os.File
+}
+
+func newExternalSorter(chunkSize int) *externalSorter {
+	return &externalSorter{chunkSize: chunkSize}
+}
+
+// add takes another entry, spilling the buffer to disk when it is full.
+func (s *externalSorter) add(entry ldapEntry) error {
+	s.buffer = append(s.buffer, entry)
+	if len(s.buffer) < s.chunkSize {
+		return nil
+	}
+	return s.spill()
+}
+
+func (s *externalSorter) sortBuffer() {
+	sort.Slice(s.buffer, func(i, j int) bool { return s.buffer[i].dn_trunc < s.buffer[j].dn_trunc })
+}
+
+// spill writes the buffer as a sorted run to a temporary file.
+func (s *externalSorter) spill() error {
+	s.sortBuffer()
+	run, err := os.CreateTemp("", "ldap_sdiff_sort")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	writer := bufio.NewWriter(run)
+	encoder := gob.NewEncoder(writer)
+	for _, entry := range s.buffer {
+		if err := encoder.Encode(sortRecord{entry.dn_trunc, entry.dn, entry.modify_timestamp, entry.attributes, entry.group}); err != nil {
+			return err
+		}
+	}
+	s.buffer = s.buffer[:0]
+	return writer.Flush()
+}
+
+// sortRun is one source of already sorted entries being merged.
+type sortRun struct {
+	next    ldapEntry
+	decoder *gob.Decoder
+	buffer  []ldapEntry // the in-memory chunk when decoder is nil
+}
+
+// advance moves the run on to its next entry, returning false at the end of the run.
+func (r *sortRun) advance() (bool, error) {
+	if r.decoder == nil {
+		if len(r.buffer) == 0 {
+			return false, nil
+		}
+		r.next, r.buffer = r.buffer[0], r.buffer[1:]
+		return true, nil
+	}
+	var record sortRecord
+	if err := r.decoder.Decode(&record); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	r.next = ldapEntry{dn_trunc: record.Key, dn: record.DN, modify_timestamp: record.Timestamp, attributes: record.Attributes, group: record.Group}
+	return true, nil
+}
+
+// runHeap orders the runs by their next entry.
+type runHeap []*sortRun
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].next.dn_trunc < h[j].next.dn_trunc }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// sorted sends all the entries added, in dn_trunc order and restricted to the range, to out until ctx is
+// cancelled.  The temporary files are removed afterwards.
+func (s *externalSorter) sorted(ctx context.Context, r keyRange, out chan<- ldapEntry) error {
+	defer s.cleanup()
+	s.sortBuffer()
+	runs := &runHeap{}
+	candidates := []*sortRun{{buffer: s.buffer}}
+	for _, file := range s.runs {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		candidates = append(candidates, &sortRun{decoder: gob.NewDecoder(bufio.NewReader(file))})
+	}
+	for _, run := range candidates {
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(runs, run)
+		}
+	}
+	for runs.Len() > 0 {
+		run := (*runs)[0]
+		if r.contains(run.next.dn_trunc) && !sendEntry(ctx, out, run.next) {
+			return ctx.Err()
+		}
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(runs, 0)
+		} else {
+			heap.Pop(runs)
+		}
+	}
+	return nil
+}
+
+// cleanup removes the temporary run files.
+func (s *externalSorter) cleanup() {
+	for _, run := range s.runs {
+		run.Close()
+		os.Remove(run.Name())
+	}
+	s.runs = nil
+	s.buffer = nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// entrySource is one side of a comparison, something the entries can be read from in dn_trunc order and looked up
+// in again for the recheck.
+type entrySource interface {
+	// label identifies the source in reports.
+	label() string
+	// listEntries sends the entries in the range to out in dn_trunc order and closes it.  A failure is sent as a
+	// final entry carrying the error.  Reading stops when ctx is cancelled.
+	listEntries(ctx context.Context, r keyRange, out chan<- ldapEntry)
+	// lookupEntry fetches the current modify_timestamp of a single entry, "" when it does not exist.  The entry is
+	// given by its dn_trunc key and by its full DN, as the key is no use as a search base once truncated.  Sources
+	// that can't change, such as exports, return false and keep the timestamps they were compared with.
+	lookupEntry(ctx context.Context, key string, dn string) (string, bool, error)
+}
+
+// db2Source reads the entries straight from the ldap_entry table of the DB2 database underlying SDS.
+type db2Source struct {
+	hostname     string
+	port         int
+	dbname       string
+	userid       string
+	password     string
+	schema       string
+	conn         *sql.DB
+	queryTimeout time.Duration // time allowed for each query, 0 for no limit
+	members      bool          // mark the entries that are groups
+}
+
+func (s *db2Source) label() string {
+	return fmt.Sprintf("%s:%d/%s", s.hostname, s.port, s.dbname)
+}
+
+func (s *db2Source) connectionString() string {
+	return fmt.Sprintf("HOSTNAME=%s;DATABASE=%s;PORT=%d;UID=%s;PWD=%s", s.hostname, s.dbname, s.port, s.userid, s.password)
+}
+
+func (s *db2Source) listEntries(ctx context.Context, r keyRange, out chan<- ldapEntry) {
+	listAllEntries(ctx, s.conn, s.schema, r, s.queryTimeout, s.members, out)
+}
+
+func (s *db2Source) lookupEntry(ctx context.Context, key string, dn string) (string, bool, error) {
+	lookupCtx, cancel := queryContext(ctx, s.queryTimeout)
+	defer cancel()
+	timestamp, err := lookupEntry(lookupCtx, s.conn, s.schema, key)
+	return timestamp, true, err
+}
+
+// sliceSource serves entries held in memory, which must already be in dn_trunc order, so the comparison can be
+// run without any servers.  An entry carrying an error stands for a source failing at that point.
+type sliceSource struct {
+	name    string
+	entries []ldapEntry
+}
+
+func (s *sliceSource) label() string {
+	return s.name
+}
+
+func (s *sliceSource) listEntries(ctx context.Context, r keyRange, out chan<- ldapEntry) {
+	defer close(out)
+	for _, entry := range s.entries {
+		if entry.err == nil && !r.contains(entry.dn_trunc) {
+			continue
+		}
+		if !sendEntry(ctx, out, entry) || entry.err != nil {
+			return
+		}
+	}
+}
+
+func (s *sliceSource) lookupEntry(ctx context.Context, key string, dn string) (string, bool, error) {
+	return "", false, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	older  = "2024-01-01T00:00:00.000000Z"
+	newer  = "2024-01-01T00:00:03.000000Z"
+	newest = "2024-01-02T00:00:00.000000Z"
+)
+
+// entry is an entry whose DN fits in dn_trunc.
+func entry(dn string, timestamp string) ldapEntry {
+	return ldapEntry{dn_trunc: dn, dn: dn, modify_timestamp: timestamp}
+}
+
+// long is a DN that fills dn_trunc, so DNs starting with it share their dn_trunc.
+var long = "CN=" + strings.Repeat("X", dnTruncLength-3)
+
+// truncated is an entry whose DN is longer than dn_trunc, so other entries can share its dn_trunc.
+func truncated(dn string, timestamp string) ldapEntry {
+	return ldapEntry{dn_trunc: normalizeDN(dn), dn: dn, modify_timestamp: timestamp}
+}
+
+// failed is the entry a source sends when it fails.
+func failed(message string) ldapEntry {
+	return ldapEntry{err: errors.New(message)}
+}
+
+func TestCompareSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		servers  [][]ldapEntry
+		options  compareOptions
+		want     []difference
+		compared int
+		err      bool
+	}{
+		{
+			name:    "both sides empty",
+			servers: [][]ldapEntry{nil, nil},
+		},
+		{
+			name:     "first side empty",
+			servers:  [][]ldapEntry{nil, {entry("A", older), entry("B", older)}},
+			compared: 2,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+				{dn: "B", fullDN: "B", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+			},
+		},
+		{
+			name:     "second side empty",
+			servers:  [][]ldapEntry{{entry("A", older)}, nil},
+			compared: 1,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: missingEntry, timestamps: []string{older, ""}, expected: older},
+			},
+		},
+		{
+			name: "identical",
+			servers: [][]ldapEntry{
+				{entry("A", older), entry("B", newer)},
+				{entry("A", older), entry("B", newer)},
+			},
+			compared: 2,
+		},
+		{
+			name: "interleaved misses",
+			servers: [][]ldapEntry{
+				{entry("A", older), entry("C", older), entry("E", older)},
+				{entry("B", older), entry("C", older), entry("D", older)},
+			},
+			compared: 5,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: missingEntry, timestamps: []string{older, ""}, expected: older},
+				{dn: "B", fullDN: "B", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+				{dn: "D", fullDN: "D", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+				{dn: "E", fullDN: "E", kind: missingEntry, timestamps: []string{older, ""}, expected: older},
+			},
+		},
+		{
+			// Eight partitions by the first character, no more than two of them started ahead of the report
+			name: "parallel partitions reported in order",
+			servers: [][]ldapEntry{
+				{entry("B", older), entry("G", older), entry("M", older), entry("Z", older)},
+				{entry("C", older), entry("G", newest), entry("Y", older), entry("Z", older)},
+			},
+			options:  compareOptions{parallel: 2, partitionByRDN: true},
+			compared: 6,
+			want: []difference{
+				{dn: "B", fullDN: "B", kind: missingEntry, timestamps: []string{older, ""}, expected: older},
+				{dn: "C", fullDN: "C", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+				{dn: "G", fullDN: "G", kind: timestampMismatch, timestamps: []string{older, newest}, expected: newest},
+				{dn: "M", fullDN: "M", kind: missingEntry, timestamps: []string{older, ""}, expected: older},
+				{dn: "Y", fullDN: "Y", kind: missingEntry, timestamps: []string{"", older}, expected: older},
+			},
+		},
+		{
+			name: "duplicate on one side",
+			servers: [][]ldapEntry{
+				{entry("A", older), entry("A", newer), entry("B", older)},
+				{entry("A", older), entry("B", older)},
+			},
+			compared: 3,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: missingEntry, timestamps: []string{newer, ""}, expected: newer},
+			},
+		},
+		{
+			name: "truncation collision held on both sides",
+			servers: [][]ldapEntry{
+				{truncated(long+"1", older), truncated(long+"2", newer)},
+				{truncated(long+"1", older), truncated(long+"2", newer)},
+			},
+			compared: 2,
+		},
+		{
+			// DB2 returns the rows sharing a dn_trunc in no particular order
+			name: "truncation collision held on both sides in another order",
+			servers: [][]ldapEntry{
+				{truncated(long+"1", older), truncated(long+"2", newer)},
+				{truncated(long+"2", newer), truncated(long+"1", older)},
+			},
+			compared: 2,
+		},
+		{
+			name: "truncation collision held on one side",
+			servers: [][]ldapEntry{
+				{truncated(long+"2", newer), truncated(long+"1", older)},
+				{truncated(long+"1", older)},
+			},
+			compared: 2,
+			want: []difference{
+				{dn: long, fullDN: long + "2", kind: missingEntry, timestamps: []string{newer, ""}, expected: newer},
+			},
+		},
+		{
+			name: "mismatched timestamps",
+			servers: [][]ldapEntry{
+				{entry("A", older), entry("B", newest)},
+				{entry("A", newest), entry("B", newest)},
+			},
+			compared: 2,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: timestampMismatch, timestamps: []string{older, newest}, expected: newest},
+			},
+		},
+		{
+			name: "mismatched timestamps, the majority expected",
+			servers: [][]ldapEntry{
+				{entry("A", older)},
+				{entry("A", newest)},
+				{entry("A", older)},
+			},
+			compared: 1,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: timestampMismatch, timestamps: []string{older, newest, older}, expected: older},
+			},
+		},
+		{
+			name: "mismatched timestamps within the tolerance",
+			servers: [][]ldapEntry{
+				{entry("A", older), entry("B", older)},
+				{entry("A", newer), entry("B", newest)},
+			},
+			options:  compareOptions{rules: inFlightRules{tolerance: 5 * time.Second}},
+			compared: 2,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: changeInFlight, timestamps: []string{older, newer}, expected: newer},
+				{dn: "B", fullDN: "B", kind: timestampMismatch, timestamps: []string{older, newest}, expected: newest},
+			},
+		},
+		{
+			// sliceSource can't list members, so comparing those of A would fail
+			name: "members only compared for groups",
+			servers: [][]ldapEntry{
+				{entry("A", older)},
+				{entry("A", newest)},
+			},
+			options:  compareOptions{members: true},
+			compared: 1,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: timestampMismatch, timestamps: []string{older, newest}, expected: newest},
+			},
+		},
+		{
+			name: "timestamp missing on one side",
+			servers: [][]ldapEntry{
+				{entry("A", unknownTimestamp)},
+				{entry("A", older)},
+			},
+			compared: 1,
+			want: []difference{
+				{dn: "A", fullDN: "A", kind: notComparable, timestamps: []string{unknownTimestamp, older}, expected: older},
+			},
+		},
+		{
+			name: "source failing part way through",
+			servers: [][]ldapEntry{
+				{entry("A", older), failed("connection reset")},
+				{entry("A", older), entry("B", older), entry("C", older)},
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			servers := make([]entrySource, len(test.servers))
+			labels := make([]string, len(test.servers))
+			for i, entries := range test.servers {
+				labels[i] = serverOrdinal(i)
+				servers[i] = &sliceSource{name: labels[i], entries: entries}
+			}
+			var got differenceList
+			summary := newDiffSummary(labels)
+			err := compareSources(context.Background(), servers, test.options, &got, summary)
+			if (err != nil) != test.err {
+				t.Fatalf("compareSources() error = %v, want error %v", err, test.err)
+			}
+			if test.err {
+				// The entries after the failure must not be reported as missing from the source that failed.
+				if len(got) > 0 {
+					t.Errorf("compareSources() reported %v after the source failed", got)
+				}
+				return
+			}
+			if summary.compared != test.compared {
+				t.Errorf("compared %d entries, want %d", summary.compared, test.compared)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got differences %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i], test.want[i]) {
+					t.Errorf("difference %d = %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeDN(t *testing.T) {
+	long := "cn=" + strings.Repeat("x", dnTruncLength-4) + "é,o=ibm"
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{"cn=John Smith, ou=People, o=IBM", "CN=JOHN SMITH,OU=PEOPLE,O=IBM"},
+		{`cn=Smith\, John,ou=People,o=IBM`, `CN=SMITH\, JOHN,OU=PEOPLE,O=IBM`},
+		{`cn=a\+b,o=x`, `CN=A\+B,O=X`},
+		{"cn=a+sn=b,o=x", "CN=A+SN=B,O=X"},
+		{`cn=\#1\ ,o=x`, `CN=\#1\ ,O=X`},
+		// The cut falls in the middle of the É, which is dropped whole
+		{long, "CN=" + strings.Repeat("X", dnTruncLength-4)},
+	}
+	for _, test := range tests {
+		if got := normalizeDN(test.dn); got != test.want {
+			t.Errorf("normalizeDN(%q) = %q, want %q", test.dn, got, test.want)
+		}
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	servers := []string{"first", "second"}
+	summary := newDiffSummary(servers)
+	summary.compared, summary.mismatches, summary.members, summary.resolved = 10, 2, 3, 1
+	flagged := []difference{{dn: "A", fullDN: "cn=a", kind: timestampMismatch, timestamps: []string{older, newer}, expected: newer}}
+	groups := []difference{{dn: "G", fullDN: "cn=g", kind: timestampMismatch, timestamps: []string{older, newest}, expected: newest, group: true}}
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if err := saveCheckpoint(filename, "G", summary, flagged, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newDiffSummary(servers)
+	lastDN, gotFlagged, gotGroups, err := loadCheckpoint(filename, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastDN != "G" {
+		t.Errorf("lastDN = %q, want G", lastDN)
+	}
+	if restored.compared != 10 || restored.mismatches != 2 || restored.members != 3 || restored.resolved != 1 {
+		t.Errorf("restored totals %+v, want those saved %+v", restored, summary)
+	}
+	if !reflect.DeepEqual(gotFlagged, flagged) {
+		t.Errorf("flagged = %+v, want %+v", gotFlagged, flagged)
+	}
+	if !reflect.DeepEqual(gotGroups, groups) {
+		t.Errorf("groups = %+v, want %+v", gotGroups, groups)
+	}
+}